@@ -2,8 +2,6 @@ package balancer
 
 import (
 	"github.com/sirupsen/logrus"
-	"strconv"
-	"strings"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer"
@@ -14,6 +12,7 @@ import (
 type AddrInfo struct {
 	Addr            grpc.Address
 	Connected       bool
+	Offline         bool // metadata 中 active=1，不参与负载均衡
 	Weight          int
 	CurrentWeight   int
 	EffectiveWeight int
@@ -27,52 +26,54 @@ type AddrInfoNew struct {
 	EffectiveWeight int
 }
 
-func GetWeightByMetadata(meta interface{}) int {
-	if metaStr, ok := meta.(string); ok {
-		items := strings.Split(metaStr, "&")
-		for _, item := range items {
-			kv := strings.Split(item, "=")
-			if len(kv) != 2 {
-				logrus.Warnf("metadata[%s] format invalid\n", metaStr)
-				continue
-			}
-			if kv[0] == "weight" {
-				weight, err := strconv.Atoi(kv[1])
-				if err != nil {
-					logrus.Warnf("strconv.Atoi(%s) failed, use default value[%d] error: %s\n", kv[1], config.MetaDefaultWeight, err)
-					return config.MetaDefaultWeight
-				} else if weight < 0 {
-					logrus.Warnf("get weight[%d] less than zero, use default value[%d]", weight, config.MetaDefaultWeight)
-					return config.MetaDefaultWeight
-				} else {
-					return weight
-				}
-			}
+// ParseMetadata 解析 resolver 返回的 metadata，支持 config.MetaDataInner 和 metadata 字符串
+func ParseMetadata(meta interface{}) config.MetaDataInner {
+	switch m := meta.(type) {
+	case config.MetaDataInner:
+		return m
+	case *config.MetaDataInner:
+		if m != nil {
+			return *m
+		}
+	case string:
+		inner, err := config.ParseMetaDataInner(m)
+		if err != nil {
+			logrus.Warnf("metadata[%s] invalid, use default value, error: %s\n", m, err)
 		}
-	} else {
-		logrus.Warnf("metadata[%s] is not string\n", meta)
+		return inner
+	default:
+		logrus.Warnf("metadata[%v] is not string\n", meta)
 	}
-	return config.MetaDefaultWeight
+	return config.DefaultMetaDataInner
+}
+
+func GetWeightByMetadata(meta interface{}) int {
+	return ParseMetadata(meta).Weight
 }
 
 func GetAvailableAddrs(all []*AddrInfo, weight bool, connected bool) []*AddrInfo {
 	addrs := make([]*AddrInfo, 0, len(all))
 	for _, a := range all {
-		if (!connected || a.Connected) && (!weight || a.Weight > 0) {
+		if !a.Offline && (!connected || a.Connected) && (!weight || a.Weight > 0) {
 			addrs = append(addrs, a)
 		}
 	}
 	return addrs
 }
 
-func TransformReadySCs(readySCs map[resolver.Address]balancer.SubConn) []*AddrInfoNew {
-	addrInfo := make([]*AddrInfoNew, 0)
+// TransformReadySCs 返回在线的 SubConn，weight 为 true 时不包含权重为 0 的 SubConn
+// 在 PickerBuilder.Build 中调用，picker 保存返回值以便加权轮询保留 CurrentWeight
+func TransformReadySCs(readySCs map[resolver.Address]balancer.SubConn, weight bool) []*AddrInfoNew {
+	addrInfo := make([]*AddrInfoNew, 0, len(readySCs))
 	for k, v := range readySCs {
-		weight := GetWeightByMetadata(k.Metadata)
+		meta := ParseMetadata(k.Metadata)
+		if !meta.Online() || (weight && meta.Weight <= 0) {
+			continue
+		}
 		info := &AddrInfoNew{
 			Addr:            k.Addr,
-			Weight:          weight,
-			EffectiveWeight: weight,
+			Weight:          meta.Weight,
+			EffectiveWeight: meta.Weight,
 			SubConn:         v,
 		}
 		addrInfo = append(addrInfo, info)
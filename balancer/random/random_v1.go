@@ -5,8 +5,8 @@ import (
 	"errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/naming"
-	"log"
 	"math/rand"
 	"openWebSF/balancer"
 	"openWebSF/config"
@@ -64,7 +64,6 @@ func (b *random) Start(target string, config grpc.BalancerConfig) error {
 func (b *random) Up(addr grpc.Address) (down func(error)) {
 	b.Lock()
 	defer b.Unlock()
-	var cnt int
 	for _, a := range b.addrs {
 		if a.Addr == addr {
 			if a.Connected {
@@ -72,15 +71,8 @@ func (b *random) Up(addr grpc.Address) (down func(error)) {
 			}
 			a.Connected = true
 		}
-		if a.Connected {
-			cnt++
-		}
-	}
-	// addr is only one which is connected. Notify the Get() callers who are blocking.
-	if cnt == 1 && b.waitCh != nil {
-		close(b.waitCh)
-		b.waitCh = nil
 	}
+	b.notifyWaiters()
 	return func(err error) {
 		b.down(addr, err)
 	}
@@ -174,7 +166,7 @@ func (b *random) Close() error {
 func (b *random) watchAddrUpdates() error {
 	updates, err := b.w.Next()
 	if err != nil {
-		log.Fatalln("grpc: the naming watcher stops working due to %v.\n", err)
+		grpclog.Warningf("grpc: the naming watcher stops working due to %v.", err)
 		return err
 	}
 	b.Lock()
@@ -188,7 +180,8 @@ func (b *random) watchAddrUpdates() error {
 		case naming.Add:
 			var exist bool
 			for _, v := range b.addrs {
-				if addr == v.Addr {
+				// Modify 之后 v.Addr.Metadata 与最新的 metadata 不同，只比较地址
+				if addr.Addr == v.Addr.Addr {
 					exist = true
 					break
 				}
@@ -196,18 +189,19 @@ func (b *random) watchAddrUpdates() error {
 			if exist {
 				continue
 			}
+			meta := balancer.ParseMetadata(addr.Metadata)
 			b.addrs = append(b.addrs, &balancer.AddrInfo{
-				Addr:   addr,
-				Weight: balancer.GetWeightByMetadata(addr.Metadata),
+				Addr:    addr,
+				Offline: !meta.Online(),
+				Weight:  meta.Weight,
 			})
 		case config.Modify:
-			// 现在只会修改weight值，所以不根据权重做负载均衡时直接continue
-			if !b.weight {
-				continue
-			}
+			// 只更新权重和上下线状态，v.Addr 不变，避免 grpc 重新建立连接
 			for _, v := range b.addrs {
 				if v.Addr.Addr == addr.Addr {
-					v.Weight = balancer.GetWeightByMetadata(addr.Metadata)
+					meta := balancer.ParseMetadata(addr.Metadata)
+					v.Offline = !meta.Online()
+					v.Weight = meta.Weight
 					break
 				}
 			}
@@ -223,6 +217,8 @@ func (b *random) watchAddrUpdates() error {
 			logrus.Warnln("Unknown update.Op ", update.Op)
 		}
 	}
+	// 下线的实例重新上线时唤醒阻塞的 Get()
+	b.notifyWaiters()
 	// Make a copy of b.addrs and write it onto b.addrCh so that gRPC internals gets notified.
 	open := make([]grpc.Address, len(b.addrs))
 	for i, v := range b.addrs {
@@ -235,6 +231,14 @@ func (b *random) watchAddrUpdates() error {
 	return nil
 }
 
+// notifyWaiters 有可用的连接（已连接并且在线）时唤醒阻塞的 Get()，调用时必须持有锁
+func (b *random) notifyWaiters() {
+	if b.waitCh != nil && len(balancer.GetAvailableAddrs(b.addrs, b.weight, true)) > 0 {
+		close(b.waitCh)
+		b.waitCh = nil
+	}
+}
+
 // len(addrs) must bigger than 0
 func (b *random) selectOneAddr(addrs []*balancer.AddrInfo) grpc.Address {
 	if len(addrs) == 1 {
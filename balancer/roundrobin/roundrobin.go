@@ -28,13 +28,15 @@ type rrPickerBuilder struct {
 
 func (rr *rrPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
 	grpclog.Infof("roundrobinPicker: newPicker called with readySCs: %v", readySCs)
+	// 下线的实例不参与负载均衡
+	addrInfo := ub.TransformReadySCs(readySCs, rr.weight)
 	var scs []balancer.SubConn
-	for _, sc := range readySCs {
-		scs = append(scs, sc)
+	for _, info := range addrInfo {
+		scs = append(scs, info.SubConn)
 	}
 	return &rrPicker{
 		subConns: scs,
-		readySCs: readySCs,
+		addrInfo: addrInfo,
 		weight: rr.weight,
 	}
 }
@@ -44,7 +46,7 @@ type rrPicker struct {
 	// created. The slice is immutable. Each Get() will do a round robin
 	// selection from it and return the selected SubConn.
 	subConns []balancer.SubConn
-	readySCs map[resolver.Address]balancer.SubConn
+	addrInfo []*ub.AddrInfoNew // 与 subConns 对应，保存加权轮询的 CurrentWeight
 
 	weight bool
 	mu   sync.Mutex
@@ -59,8 +61,7 @@ func (p *rrPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balance
 	// 基于权重
 	if p.weight {
 		p.mu.Lock()
-		addrInfo := ub.TransformReadySCs(p.readySCs)
-		sc := p.selectOneAddr(addrInfo)
+		sc := p.selectOneAddr(p.addrInfo)
 		p.mu.Unlock()
 		return sc, nil, nil
 	}
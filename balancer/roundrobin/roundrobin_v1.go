@@ -52,7 +52,8 @@ func (rr *roundRobin) watchAddrUpdates() error {
 		case naming.Add:
 			var exist bool
 			for _, v := range rr.addrs {
-				if addr == v.Addr {
+				// Modify 之后 v.Addr.Metadata 与最新的 metadata 不同，只比较地址
+				if addr.Addr == v.Addr.Addr {
 					exist = true
 					grpclog.Infoln("grpc: The name resolver wanted to add an existing address: ", addr)
 					break
@@ -61,16 +62,18 @@ func (rr *roundRobin) watchAddrUpdates() error {
 			if exist {
 				continue
 			}
-			weight := balancer.GetWeightByMetadata(addr.Metadata)
-			logrus.Debugf("%s add %s weight[%d]", method, addr.Addr, weight)
+			meta := balancer.ParseMetadata(addr.Metadata)
+			logrus.Debugf("%s add %s weight[%d] active[%d]", method, addr.Addr, meta.Weight, meta.Active)
 			rr.addrs = append(rr.addrs, &balancer.AddrInfo{
 				Addr: addr,
-				Weight: weight,
-				EffectiveWeight: weight,
+				Offline: !meta.Online(),
+				Weight: meta.Weight,
+				EffectiveWeight: meta.Weight,
 			})
 		case naming.Delete:
 			for i, v := range rr.addrs {
-				if addr == v.Addr {
+				// Modify 之后 v.Addr.Metadata 与最新的 metadata 不同，只比较地址
+				if addr.Addr == v.Addr.Addr {
 					copy(rr.addrs[i:], rr.addrs[i+1:])
 					rr.addrs = rr.addrs[:len(rr.addrs)-1]
 					break
@@ -78,15 +81,14 @@ func (rr *roundRobin) watchAddrUpdates() error {
 			}
 			rr.next = -1 // 后端服务地址减少时，重置 next
 		case config.Modify:
-			if !rr.weight {
-				continue
-			}
+			// 只更新权重和上下线状态，v.Addr 不变，避免 grpc 重新建立连接
 			for _, v := range rr.addrs {
 				if addr.Addr == v.Addr.Addr {
-					weight := balancer.GetWeightByMetadata(addr.Metadata)
-					logrus.Debugf("%s modify %s weight[%d]", method, addr.Addr, weight)
-					v.Weight = weight
-					v.EffectiveWeight = weight
+					meta := balancer.ParseMetadata(addr.Metadata)
+					logrus.Debugf("%s modify %s weight[%d] active[%d]", method, addr.Addr, meta.Weight, meta.Active)
+					v.Offline = !meta.Online()
+					v.Weight = meta.Weight
+					v.EffectiveWeight = meta.Weight
 					break
 				}
 			}
@@ -94,6 +96,8 @@ func (rr *roundRobin) watchAddrUpdates() error {
 			grpclog.Errorln("Unknown update.Op ", update.Op)
 		}
 	}
+	// 下线的实例重新上线时唤醒阻塞的 Get()
+	rr.notifyWaiters()
 	// Make a copy of rr.addrs and write it onto rr.addrCh so that gRPC internals gets notified.
 	open := make([]grpc.Address, len(rr.addrs))
 	for i, v := range rr.addrs {
@@ -141,7 +145,6 @@ func (rr *roundRobin) Start(target string, config grpc.BalancerConfig) error {
 func (rr *roundRobin) Up(addr grpc.Address) func(error) {
 	rr.mu.Lock()
 	defer rr.mu.Unlock()
-	var cnt int
 	for _, a := range rr.addrs {
 		if a.Addr == addr {
 			if a.Connected {
@@ -149,15 +152,8 @@ func (rr *roundRobin) Up(addr grpc.Address) func(error) {
 			}
 			a.Connected = true
 		}
-		if a.Connected {
-			cnt++
-		}
-	}
-	// addr is only one which is connected. Notify the Get() callers who are blocking.
-	if cnt == 1 && rr.waitCh != nil {
-		close(rr.waitCh)
-		rr.waitCh = nil
 	}
+	rr.notifyWaiters()
 	return func(err error) {
 		rr.down(addr, err)
 	}
@@ -268,6 +264,14 @@ func (rr *roundRobin) Close() error {
 	return nil
 }
 
+// notifyWaiters 有可用的连接（已连接并且在线）时唤醒阻塞的 Get()，调用时必须持有 rr.mu
+func (rr *roundRobin) notifyWaiters() {
+	if rr.waitCh != nil && len(balancer.GetAvailableAddrs(rr.addrs, rr.weight, true)) > 0 {
+		close(rr.waitCh)
+		rr.waitCh = nil
+	}
+}
+
 // len(addrs) must bigger than 0
 func (rr *roundRobin) selectOneAddr(addrs []*balancer.AddrInfo) grpc.Address {
 	if len(addrs) == 1 {
@@ -2,9 +2,13 @@ package client
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	_ "google.golang.org/grpc/health" // 注册客户端 health check 的实现，experimental 的 balancer 根据 health 状态选择实例
 	"google.golang.org/grpc/naming"
 	"openWebSF/balancer/random"
 	"openWebSF/balancer/roundrobin"
@@ -14,7 +18,11 @@ import (
 	client_timeout "openWebSF/interceptor/timeout"
 	"openWebSF/registry"
 	"openWebSF/resolver"
+	"openWebSF/utils"
+	"openWebSF/utils/tlsutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -41,34 +49,59 @@ const (
 
 type ClientConfig struct {
 	Service          string            // 服务名， 不为空的时候通过服务名发现服务
+	Group            string            // 服务分组，默认为 NODE_CLUSTER 环境变量的值（本集群）
+	FailoverGroups   []string          // 按优先级排列的备用分组，Group 中没有可用的实例时依次使用
 	Registry         string            // zk或其它注册中心地址，使用直连方式时此字段为空
-	DirectAddr       map[string]string // Service字段为空时需要设置直接的地址
+	DirectAddr       map[string]string // 直连的地址，Registry 为空时生效，key 为 ip:port，value 为 metadata（例如 weight=50），为空时使用默认值
 	Balancer         Balancer          // 负载均衡器，不设置则使用默认的,默认值为WRoundRobin, 使用expreimental相关的接口的时候必须设置
 	Experimental     bool              // 是否是采用grpc expreimental相关的接口 false表示不是
 	dialOpts         []grpc.DialOption
+	TLS              *config.TLSConfig            // TLS 配置，为 nil 时只对注册中心 metadata 中 tls=1 的实例使用 TLS，并使用系统的 CA 验证服务端证书；PerRPCCredentials 要求 TLS 时需要设置 Enable
+	DialOptions      []grpc.DialOption            // grpc.Dial 的参数，例如 keepalive、消息大小的限制，interceptor 通过 AddUnaryInterceptor/AddStreamInterceptor 添加
 	StreamInt        grpc.StreamClientInterceptor // 设置interceptor
 	UnaryInt         grpc.UnaryClientInterceptor
-	ReqTimeout       int // 请求超时，单位 ms，默认 6000 ms
-	MonitorThreshold int // 打印 monitor 日志的阈值，单位 ms，默认 10 ms
+	ReqTimeout       int    // 请求超时，单位 ms，默认 6000 ms
+	MonitorThreshold int    // 打印 monitor 日志的阈值，单位 ms，默认 10 ms
+	SnapshotDir      string // 服务地址快照的目录，注册中心不可用时使用快照中的地址，默认为 config.Default.SnapshotDir
+	Caller           string // 调用方的应用名，通过 metadata 传给服务端用于按调用方限流，默认为 config.Default.AppName
 }
 
+// register 按注册中心地址缓存 client 使用的注册中心连接，key 为 registryKey 的结果
 var register = struct {
 	sync.RWMutex
-	r *registry.Registry
-}{}
+	m map[string]registry.Registry
+}{
+	m: make(map[string]registry.Registry),
+}
 
-func experimentInit(conf ClientConfig) string {
-	switch {
-	case conf.Service != "":
-		resolver.Init(conf.Service)
-		if conf.Registry == "" {
-			logrus.Fatalln("NewClient must specify ClientConfig.Registry")
+// groups 返回按优先级排列的分组，Group 排在第一个
+func (c *ClientConfig) groups() []string {
+	group := c.Group
+	if group == "" {
+		group = config.Default.Group
+	}
+	groups := []string{group}
+	for _, g := range c.FailoverGroups {
+		if g != "" && g != group {
+			groups = append(groups, g)
 		}
-	case len(conf.DirectAddr) > 0:
-	default:
-		logrus.Fatalln("NewClient() parameter invalid, must set ClientConfig.Server or ClientConfig.DirectIP")
 	}
+	return groups
+}
+
+// isDirect 设置了 DirectAddr 并且没有设置 Registry 时采用直连方式，此时 Service 只用于日志
+func (c *ClientConfig) isDirect() bool {
+	return len(c.DirectAddr) > 0 && c.Registry == ""
+}
+
+var (
+	errNoRegistry = errors.New("NewClient() parameter invalid, must specify ClientConfig.Registry")
+	errNoTarget   = errors.New("NewClient() parameter invalid, must set ClientConfig.Service or ClientConfig.DirectAddr")
+	errBalancer   = errors.New("NewClient() parameter invalid, unsupported balancer type")
+)
 
+// experimentInit 返回 balancer 的名称、grpc.Dial 使用的 target 和实例是否要求 TLS
+func experimentInit(conf ClientConfig) (string, string, *tlsutil.Instances, error) {
 	var name string
 	switch conf.Balancer {
 	case WRoundRobinExperimental:
@@ -80,21 +113,46 @@ func experimentInit(conf ClientConfig) string {
 	case WRandomExperimental:
 		name = random.Init(true)
 	default:
-		logrus.Fatalln("NewClient() parameter invalid, unsupported balancer type")
+		return "", "", nil, errBalancer
+	}
+
+	var target string
+	var instances *tlsutil.Instances
+	switch {
+	case conf.isDirect():
+		target, instances = resolver.InitDirect(conf.DirectAddr)
+	case conf.Service != "":
+		if conf.Registry == "" {
+			return "", "", nil, errNoRegistry
+		}
+		// 服务名和分组包含在 target 中，多个 client 共用同一个 scheme 的 resolver
+		target = resolver.Target(conf.Registry, conf.Service, conf.groups()...)
+		instances = resolver.Init(target, conf.SnapshotDir)
+	default:
+		return "", "", nil, errNoTarget
 	}
-	return name
+	return name, target, instances, nil
 }
 
-func originInit(conf ClientConfig) (grpc.Balancer, error) {
+// originInit 返回 balancer、grpc.Dial 使用的 target 和实例是否要求 TLS
+func originInit(conf ClientConfig) (grpc.Balancer, string, *tlsutil.Instances, error) {
 	var r naming.Resolver
+	var target string
+	var instances *tlsutil.Instances
 	switch {
+	case conf.isDirect():
+		direct := resolver.DirectResolve(conf.DirectAddr)
+		r, instances, target = direct, direct.Instances(), direct.Target()
 	case conf.Service != "":
-		r = resolver.ZookeeperResolve(conf.Service)
 		if conf.Registry == "" {
-			logrus.Fatalln("NewClient must have specify ClientConfig.Registry")
+			return nil, "", nil, errNoRegistry
 		}
+		zk := resolver.RegistryResolve(conf.Service, conf.Registry, conf.SnapshotDir, conf.groups()...)
+		r, instances = zk, zk.Instances()
+		// 注册中心的 scheme 可能已经注册了 experimental 的 resolver，使用 passthrough 避免 grpc 选择该 resolver
+		target = "passthrough:///" + utils.RegistryServers(conf.Registry)
 	default:
-		logrus.Fatalln("NewClient() parameter invalid, must set ClientConfig.Server or ClientConfig.DirectIP")
+		return nil, "", nil, errNoTarget
 	}
 
 	var b grpc.Balancer
@@ -108,54 +166,171 @@ func originInit(conf ClientConfig) (grpc.Balancer, error) {
 	case WRandom:
 		b = random.Random(r, true)
 	default:
-		logrus.Fatalln("NewClient() parameter invalid, unsupported balancer type")
+		return nil, "", nil, errBalancer
 	}
 
-	return b, nil
+	return b, target, instances, nil
 }
 
+// NewClient 参数错误或者连接失败时调用 logrus.Fatal 退出进程，需要自己处理错误时使用 NewClientE
 func NewClient(conf ClientConfig) *grpc.ClientConn {
-
-	conf.dialOpts = []grpc.DialOption{
-		grpc.WithInsecure(),
+	conn, err := NewClientE(conf)
+	if err != nil {
+		logrus.Fatalln(err)
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return conn
+}
 
+// NewClientE 与 NewClient 相同，参数错误或者连接失败时返回错误
+func NewClientE(conf ClientConfig) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var target string
+	var instances *tlsutil.Instances
+	var err error
 	if conf.Experimental {
-		name := experimentInit(conf)
+		var name string
+		name, target, instances, err = experimentInit(conf)
+		if err != nil {
+			return nil, err
+		}
 		conf.dialOpts = append(conf.dialOpts, grpc.WithBalancerName(name))
 	} else {
-		b, _ := originInit(conf)
+		var b grpc.Balancer
+		b, target, instances, err = originInit(conf)
+		if err != nil {
+			return nil, err
+		}
 		conf.dialOpts = append(conf.dialOpts, grpc.WithBalancer(b))
 	}
+	reloader, err := conf.credentials(instances)
+	if err != nil {
+		return nil, err
+	}
+	// 用户的参数覆盖默认的参数，interceptor 在最后设置
+	conf.dialOpts = append(conf.dialOpts, conf.DialOptions...)
 
 	conf.passTraceId()
+	conf.passCaller()
 	conf.setReqTimeout()
 	conf.setMonitorLog()
 
 	// after all interceptor is set, then use this function
 	conf.addInterceptorBeforeDial()
 
-	conn, err := grpc.DialContext(ctx, conf.Registry, conf.dialOpts...)
+	conn, err := grpc.DialContext(ctx, target, conf.dialOpts...)
 
 	if err != nil {
-		logrus.Fatalf("grpc.DialContext failed, service[%s]  error:%s", conf.Service, err)
-	}
-	if conf.Service != "" {
-		if nil == register.r {
-			register.Lock()
-			if r := registry.Register(conf.Registry); r == nil {
-				logrus.Fatalf("client create registry connection failed")
-			} else {
-				register.r = r
-			}
-			register.Unlock()
+		if reloader != nil {
+			reloader.Close()
 		}
-		if err := register.r.RegisterClient(conf.Service, os.Getegid()); err != nil {
+		return nil, fmt.Errorf("grpc.DialContext failed, service[%s] error: %v", conf.Service, err)
+	}
+	if conf.Service != "" && !conf.isDirect() {
+		// 注册中心不可用时 resolver 使用快照中的实例，注册 client 失败不影响连接
+		if r, err := clientRegistry(conf.Registry); err != nil {
+			logrus.Warnf("register client to registration center failed. %s", err)
+		} else if err := r.RegisterClient(conf.Service, os.Getegid(), conf.groups()[0]); err != nil {
 			logrus.Warnf("register client to registration center failed. %s", err)
 		}
 	}
-	return conn
+	if reloader != nil {
+		go closeReloader(conn, reloader)
+	}
+	return conn, nil
+}
+
+// closeReloader 连接 Close 之后停止检查证书文件
+func closeReloader(conn *grpc.ClientConn, r *tlsutil.Reloader) {
+	for state := conn.GetState(); state != connectivity.Shutdown; state = conn.GetState() {
+		conn.WaitForStateChange(context.Background(), state)
+	}
+	r.Close()
+}
+
+// clientRegistry 相同注册中心地址的 client 共用一个注册中心连接
+func clientRegistry(addr string) (registry.Registry, error) {
+	key := registryKey(addr)
+	register.Lock()
+	defer register.Unlock()
+	if r, ok := register.m[key]; ok {
+		return r, nil
+	}
+	r, err := registry.New(addr)
+	if err != nil {
+		return nil, fmt.Errorf("client create registry connection failed, error: %v", err)
+	}
+	register.m[key] = r
+	return r, nil
+}
+
+// registryKey 规范化注册中心地址，服务器列表的顺序和首尾的 / 不影响结果，
+// 例如 zookeeper:///127.0.0.2:2181,127.0.0.1:2181 和 zookeeper://127.0.0.1:2181,127.0.0.2:2181/ 相同
+func registryKey(addr string) string {
+	scheme, _ := utils.ParseRegistryAddr(addr)
+	servers, query := utils.RegistryServers(addr), ""
+	// 地址中的参数（例如 consul 的 tlsSkipVerify）不参与排序
+	if i := strings.Index(servers, "?"); i >= 0 {
+		servers, query = servers[:i], servers[i:]
+	}
+	list := strings.Split(servers, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	sort.Strings(list)
+	return scheme + "://" + strings.Join(list, ",") + query
+}
+
+// credentials 设置了 TLS 或者有实例要求 TLS 时使用 TLS 的 credentials，TLS.Enable 为 true 时所有的连接都使用 TLS，
+// 否则根据实例 metadata 中的 tls 选择 TLS 或者明文连接；都没有时使用明文连接，不会与 DialOptions 中的 grpc.WithInsecure 冲突
+func (c *ClientConfig) credentials(instances *tlsutil.Instances) (*tlsutil.Reloader, error) {
+	if c.TLS == nil && !c.requireTLS() {
+		c.dialOpts = append(c.dialOpts, grpc.WithInsecure())
+		return nil, nil
+	}
+	var conf config.TLSConfig
+	if c.TLS != nil {
+		conf = *c.TLS
+	}
+	r, err := tlsutil.NewReloader(conf)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient() load tls certificate failed, service[%s] error: %v", c.Service, err)
+	}
+	c.dialOpts = append(c.dialOpts,
+		grpc.WithTransportCredentials(r.ClientCredentials(conf.Enable, instances)),
+		grpc.WithDialer(tlsutil.Dial),
+	)
+	return r, nil
+}
+
+// requireTLS 返回是否有实例的 metadata 中 tls=1，直连时检查 DirectAddr，否则查询注册中心中服务当前的实例，
+// 查询失败时无法确定，返回 true
+func (c *ClientConfig) requireTLS() bool {
+	if c.isDirect() {
+		for _, meta := range c.DirectAddr {
+			if m, _ := config.ParseMetaDataInner(meta); m.TLS == config.MetaTLS {
+				return true
+			}
+		}
+		return false
+	}
+	r, err := clientRegistry(c.Registry)
+	if err != nil {
+		logrus.Warnf("client check tls of service[%s] failed, error: %v", c.Service, err)
+		return true
+	}
+	endpoints, err := registry.ListGroups(r, c.Service, c.groups())
+	if err != nil {
+		logrus.Warnf("client check tls of service[%s] failed, error: %v", c.Service, err)
+		return true
+	}
+	for _, endpoint := range endpoints {
+		if m, _ := config.ParseMetaDataInner(endpoint.Metadata); m.TLS == config.MetaTLS {
+			return true
+		}
+	}
+	return false
 }
 
 // set request timeout, default value is 6000ms
@@ -183,6 +358,16 @@ func (c *ClientConfig) passTraceId() {
 	c.AddUnaryInterceptor(pass_metadata.UnaryPass(config.TraceIdKey))
 }
 
+// pass caller
+func (c *ClientConfig) passCaller() {
+	caller := c.Caller
+	if caller == "" {
+		caller = config.Default.AppName
+	}
+	c.AddStreamInterceptor(pass_metadata.StreamAppend(config.CallerKey, caller))
+	c.AddUnaryInterceptor(pass_metadata.UnaryAppend(config.CallerKey, caller))
+}
+
 func (c *ClientConfig) addInterceptorBeforeDial() {
 	if c.UnaryInt != nil {
 		c.dialOpts = append(c.dialOpts, grpc.WithUnaryInterceptor(c.UnaryInt))
@@ -1,36 +1,61 @@
 package config
 
 import (
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"net"
 	"os"
+	"path/filepath"
 )
 
 const nodeClusterKey = "NODE_CLUSTER"
+const snapshotDirKey = "OWSF_SNAPSHOT_DIR" // 服务地址快照的目录，设置为 "-" 时不使用快照
 const DefaultGroup = "default"
 
 type config struct {
-	LocalIPv4      string
+	LocalIP        string // 注册到注册中心的 IP（IPv4 或者 IPv6），默认为本机第一个可用的 IPv4 地址，没有时使用 IPv6 地址
+	LocalIPv4      string // LocalIP 为 IPv4 时与 LocalIP 相同，否则为空
 	LocalIPv4Bytes []byte
 	Schema         string
 	Namespace      string
 	Group          string
 	Lb             string
+	SnapshotDir    string // 客户端保存服务地址快照的目录，为空时不使用快照
+	AppName        string // 应用名，server 读取配置文件之后设置，客户端作为调用方的应用名传给服务端
 }
 
 // 路径在zk中
 var Default = config{
-	Schema:    "owsf",
-	Namespace: "owsf",
-	Group:     DefaultGroup,
-	Lb:        "",
+	Schema:      "owsf",
+	Namespace:   "owsf",
+	Group:       DefaultGroup,
+	Lb:          "",
+	SnapshotDir: filepath.Join(os.TempDir(), "owsf_snapshot"),
+	AppName:     filepath.Base(os.Args[0]),
 }
 
 func init() {
 	getLocalIP()
+	if env := os.Getenv(EnvInterface); env != "" {
+		if ip, err := InterfaceIP(env); err != nil {
+			logrus.Errorf("%s[%s] invalid, error: %v", EnvInterface, env, err)
+		} else {
+			setLocalIP(ip)
+		}
+	}
+	if env := os.Getenv(EnvAdvertiseIP); env != "" {
+		if err := SetLocalIP(env); err != nil {
+			logrus.Errorf("%s invalid, error: %v", EnvAdvertiseIP, err)
+		}
+	}
 	if env := os.Getenv(nodeClusterKey); env != "" {
 		Default.Group = env
 	}
+	if env := os.Getenv(snapshotDirKey); env == "-" {
+		Default.SnapshotDir = ""
+	} else if env != "" {
+		Default.SnapshotDir = env
+	}
 }
 
 // private IPv4
@@ -41,28 +66,87 @@ func init() {
 // Link-local-u 169.254.0.0           169.254.255.255      65,536
 // Link-local-m 224.0.0.0             224.0.0.255          256
 // Local        127.0.0.0             127.255.255.255      16777216
+// IPv6 除了 loopback（::1）和 link-local（fe80::/10）之外的地址都可用
 func isIPUseful(ip net.IP) bool {
 	if ip.IsLoopback() || ip.IsLinkLocalMulticast() || ip.IsLinkLocalUnicast() {
 		return false
 	}
-	ipv4 := ip.To4()
-	if ipv4 == nil {
-		return false
-	}
 	return true
 }
 
+// getLocalIP 按网卡的顺序选择第一个可用的地址，结果与网卡地址的返回顺序无关
 func getLocalIP() {
-	if addrs, err := net.InterfaceAddrs(); err != nil {
-		logrus.Panicf("Get Local IP Failed, error is: % v\n", err)
+	ip, err := InterfaceIP("")
+	if err != nil {
+		logrus.Warnf("get local ip failed, error: %v", err)
+		return
+	}
+	setLocalIP(ip)
+}
+
+// InterfaceIP 返回网卡的第一个可用的 IPv4 地址，没有时返回第一个可用的 IPv6 地址
+// name 为空时按 net.Interfaces 的顺序（网卡的 index）查找所有启用的网卡，指定网卡名时允许使用 loopback 地址
+func InterfaceIP(name string) (net.IP, error) {
+	var ifaces []net.Interface
+	if name != "" {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*iface}
 	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		ifaces = all
+	}
+
+	var ipv6 net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
 		for _, addr := range addrs {
-			if ipNet, ok := addr.(*net.IPNet); ok {
-				if isIPUseful(ipNet.IP) {
-					Default.LocalIPv4 = ipNet.IP.String()
-					Default.LocalIPv4Bytes = ipNet.IP.To4()
-				}
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !(isIPUseful(ipNet.IP) || name != "" && ipNet.IP.IsLoopback()) {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP, nil
+			}
+			if ipv6 == nil {
+				ipv6 = ipNet.IP
 			}
 		}
 	}
+	if ipv6 != nil {
+		return ipv6, nil
+	}
+	return nil, fmt.Errorf("no usable ip address found, interface[%s]", name)
+}
+
+// SetLocalIP 修改注册到注册中心的 IP，必须在注册之前调用
+func SetLocalIP(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("ip[%s] invalid", ip)
+	}
+	setLocalIP(parsed)
+	return nil
+}
+
+func setLocalIP(ip net.IP) {
+	Default.LocalIP = ip.String()
+	if ipv4 := ip.To4(); ipv4 != nil {
+		Default.LocalIPv4 = ipv4.String()
+		Default.LocalIPv4Bytes = ipv4
+	} else {
+		Default.LocalIPv4 = ""
+		Default.LocalIPv4Bytes = nil
+	}
 }
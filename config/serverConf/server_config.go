@@ -1,36 +1,106 @@
 package serverConf
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"openWebSF/config"
 	"os"
 )
 
 var Conf ConfType
 
 type ConfType struct {
-	AppName      string `yaml:"appName"`
-	LimitQPS     int    `yaml:"limitQPS"`
-	RegisterAddr string `yaml:"registry_addr"`
-	Port         int    `yaml:"port"`
-	Zk           zkConfig
-	Owner        string
+	AppName          string           `yaml:"appName"`
+	LimitQPS         int              `yaml:"limitQPS"`
+	RateLimit        RateLimitConfig  `yaml:"rateLimit"`
+	Grpc             GrpcConfig       `yaml:"grpc"`
+	TLS              config.TLSConfig `yaml:"tls"` // 设置 certFile 和 keyFile 时开启 TLS，注册中心 metadata 中的 tls 为 1
+	RegisterAddr     string           `yaml:"registry_addr"`
+	AdminAddr        string           `yaml:"admin_addr"`       // 管理接口的 HTTP 监听地址，例如 127.0.0.1:9401，为空时不启动
+	Bind             string           `yaml:"bind"`             // grpc server 监听的 IP，为空时监听所有地址，环境变量 OWSF_BIND 优先
+	Advertise        string           `yaml:"advertise"`        // 注册到注册中心的 IP，为空时使用 interface 或者自动选择，环境变量 OWSF_ADVERTISE_IP 优先
+	Interface        string           `yaml:"interface"`        // 使用该网卡的地址注册到注册中心，例如 eth0，环境变量 OWSF_INTERFACE 优先
+	ReadinessTimeout int              `yaml:"readinessTimeout"` // 等待开始接收连接和 readiness check 通过的最长时间，单位 ms，默认 30000，超时之后启动失败
+	MonitorThreshold int              `yaml:"monitorThreshold"` // 请求耗时大于等于此值时记录 monitor 日志，单位 ms，默认 10
+	Shutdown         ShutdownConfig   `yaml:"shutdown"`
+	Port             int              `yaml:"port"`
+	Zk               zkConfig
+	Owner            string
+}
+
+// RateLimitConfig 按方法和按调用方的 QPS 上限，与 limitQPS 同时生效
+type RateLimitConfig struct {
+	Methods  map[string]int      `yaml:"methods"` // key 为完整的方法名 /.proto 中的服务名/方法名，不区分大小写，例如 /ofo.user.v1.userService/QueryUserByToken
+	Callers  map[string]int      `yaml:"callers"` // key 为调用方的应用名，即调用方配置文件中的 appName
+	Cluster  map[string]int      `yaml:"cluster"` // key 为 ServiceConfig.Name（注册中心中的服务名），value 为集群所有实例的 QPS 上限之和，每个实例的上限为 value / 在线实例数
+	Adaptive AdaptiveLimitConfig `yaml:"adaptive"`
+}
+
+// AdaptiveLimitConfig 自适应并发限制，根据请求耗时动态调整允许同时处理的请求数，超过上限的请求返回 codes.Unavailable
+type AdaptiveLimitConfig struct {
+	Enable    bool `yaml:"enable"`
+	InitLimit int  `yaml:"initLimit"` // 初始的并发上限，默认 20
+	MinLimit  int  `yaml:"minLimit"`  // 默认 5
+	MaxLimit  int  `yaml:"maxLimit"`  // 默认 1000
+}
+
+// GrpcConfig grpc server 的常用参数，为 0 时使用 grpc 的默认值，时间的单位为 ms
+type GrpcConfig struct {
+	MaxRecvMsgSize        int             `yaml:"maxRecvMsgSize"`        // 单位 byte，grpc 默认 4MB
+	MaxSendMsgSize        int             `yaml:"maxSendMsgSize"`        // 单位 byte
+	MaxConcurrentStreams  uint32          `yaml:"maxConcurrentStreams"`  // 每个连接同时处理的 stream 数
+	InitialWindowSize     int32           `yaml:"initialWindowSize"`     // stream 的流控窗口，单位 byte，小于 64KB 时无效
+	InitialConnWindowSize int32           `yaml:"initialConnWindowSize"` // 连接的流控窗口，单位 byte，小于 64KB 时无效
+	ConnectionTimeout     int             `yaml:"connectionTimeout"`     // 建立连接（包括 TLS 握手）的超时时间，grpc 默认 120s
+	Keepalive             KeepaliveConfig `yaml:"keepalive"`
+}
+
+// KeepaliveConfig 对应 keepalive.ServerParameters 和 keepalive.EnforcementPolicy，时间的单位为 ms
+type KeepaliveConfig struct {
+	Time                  int  `yaml:"time"`                  // 连接空闲多久之后发送 ping，grpc 默认 2h
+	Timeout               int  `yaml:"timeout"`               // 等待 ping 响应的时间，grpc 默认 20s
+	MaxConnectionIdle     int  `yaml:"maxConnectionIdle"`     // 空闲连接的最长时间，超过之后关闭连接
+	MaxConnectionAge      int  `yaml:"maxConnectionAge"`      // 连接的最长时间，超过之后关闭连接，客户端重新建立连接时可以重新做负载均衡
+	MaxConnectionAgeGrace int  `yaml:"maxConnectionAgeGrace"` // 连接超过 maxConnectionAge 之后等待正在处理的请求的时间
+	MinTime               int  `yaml:"minTime"`               // 允许客户端 ping 的最小间隔，grpc 默认 5min，客户端 ping 得过于频繁时关闭连接
+	PermitWithoutStream   bool `yaml:"permitWithoutStream"`   // 是否允许客户端在没有 stream 时 ping
+}
+
+// ShutdownConfig 优雅退出的参数，单位 ms
+type ShutdownConfig struct {
+	DrainPeriod int `yaml:"drainPeriod"` // 从注册中心删除之后等待客户端感知的时间，默认 3000
+	Timeout     int `yaml:"timeout"`     // GracefulStop 等待正在处理的请求完成的最长时间，超过之后强制关闭，默认 10000
 }
 
 type zkConfig struct {
 	Servers string
 }
 
-func GetConfFromFile() (conf ConfType) {
-	file := ""
+// confErr init 时读取配置文件的错误，NewServer 时返回
+var confErr error
+
+// Err 返回 init 时读取配置文件或者设置地址的错误
+func Err() error {
+	return confErr
+}
+
+// configFile 返回命令行参数 -c 指定的配置文件
+func configFile() string {
 	for i := range os.Args {
 		if os.Args[i] == "-c" && len(os.Args) > i+1 {
-			file = os.Args[i+1]
-			break
+			return os.Args[i+1]
 		}
 	}
+	return ""
+}
+
+// GetConfFromFile 读取命令行参数 -c 指定的配置文件，没有指定时返回空的配置
+func GetConfFromFile() (conf ConfType, err error) {
+	file := configFile()
 	if "" == file {
 		logrus.Infoln("not specify config file")
 		return
@@ -38,54 +108,76 @@ func GetConfFromFile() (conf ConfType) {
 	return parseFile(file)
 }
 
-func ParseCustom(conf interface{}) {
-	file := ""
-
-	for i := range os.Args {
-		if os.Args[i] == "-c" && len(os.Args) > i+1 {
-			file = os.Args[i+1]
-			break
-		}
-	}
+// ParseCustom 将 -c 指定的配置文件解析到 conf 中，用于读取应用自定义的配置
+func ParseCustom(conf interface{}) error {
+	file := configFile()
 	if "" == file {
 		logrus.Infoln("not specify config file")
-		return
+		return nil
 	}
+	return unmarshalFile(file, conf)
+}
 
+func unmarshalFile(file string, conf interface{}) error {
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
-		logrus.Fatalf("read config file %s failed, error: %v", file, err)
-	} else {
-		logrus.Infof("read config file %s success", file)
+		return fmt.Errorf("read config file %s failed, error: %v", file, err)
 	}
-
+	logrus.Infof("read config file %s success", file)
 	if err := yaml.Unmarshal(content, conf); err != nil {
-		logrus.Fatalf("parse config file %s failed, error: %v", file, err)
+		return fmt.Errorf("parse config file %s failed, error: %v", file, err)
 	}
-	return
+	return nil
 }
 
-func parseFile(file string) (conf ConfType) {
-	content, err := ioutil.ReadFile(file)
-	if err != nil {
-		logrus.Fatalf("read config file %s failed, error: %v", file, err)
-	} else {
-		logrus.Infof("read config file %s success", file)
-	}
-	if err := yaml.Unmarshal(content, &conf); err != nil {
-		logrus.Fatalf("parse config file %s failed, error: %v", file, err)
+func parseFile(file string) (conf ConfType, err error) {
+	if err = unmarshalFile(file, &conf); err != nil {
+		return
 	}
-	filterConfig(&conf)
+	err = filterConfig(&conf)
 	return
 }
 
-func filterConfig(conf *ConfType) {
+func filterConfig(conf *ConfType) error {
 	if conf.AppName == "" {
-		logrus.Fatalln("config file appName is empty")
+		return errors.New("config file appName is empty")
 	}
+	return nil
 }
 
 func init() {
 	flag.String("c", "", "config file path")
-	Conf = GetConfFromFile()
+	Conf, confErr = GetConfFromFile()
+	if Conf.AppName != "" {
+		config.Default.AppName = Conf.AppName
+	}
+	if confErr == nil {
+		confErr = applyAddress(&Conf)
+	}
+	if confErr != nil {
+		logrus.Errorln(confErr)
+	}
+}
+
+// applyAddress 环境变量的优先级高于配置文件，advertise 的优先级高于 interface
+func applyAddress(conf *ConfType) error {
+	if env := os.Getenv(config.EnvBind); env != "" {
+		conf.Bind = env
+	}
+	if os.Getenv(config.EnvAdvertiseIP) != "" || os.Getenv(config.EnvInterface) != "" {
+		// config 包初始化时已经使用环境变量设置了 LocalIP
+		return nil
+	}
+	if conf.Advertise != "" {
+		if err := config.SetLocalIP(conf.Advertise); err != nil {
+			return fmt.Errorf("config file advertise invalid, error: %v", err)
+		}
+	} else if conf.Interface != "" {
+		ip, err := config.InterfaceIP(conf.Interface)
+		if err != nil {
+			return fmt.Errorf("config file interface[%s] invalid, error: %v", conf.Interface, err)
+		}
+		config.SetLocalIP(ip.String())
+	}
+	return nil
 }
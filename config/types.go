@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"google.golang.org/grpc/naming"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -10,7 +12,12 @@ const (
 	Client = "c"
 )
 
-const EnvServerWeight = "SERVER_WEIGHT" // 指定 server 权重
+const (
+	EnvServerWeight = "SERVER_WEIGHT"     // 指定 server 权重
+	EnvAdvertiseIP  = "OWSF_ADVERTISE_IP" // 注册到注册中心的 IP，优先级高于配置文件，k8s 中通过 downward API 设置为 status.podIP
+	EnvInterface    = "OWSF_INTERFACE"    // 使用该网卡的地址注册到注册中心，优先级高于配置文件
+	EnvBind         = "OWSF_BIND"         // server 监听的 IP，优先级高于配置文件
+)
 
 const (
 	Modify naming.Operation = 0xFF //扩展naming.Operation
@@ -20,8 +27,10 @@ const MetaDefaultWeight = 100
 const MetaLang = "go"
 const MetaActiveOnline = 0
 const MetaActiveOffline = 1
+const MetaTLS = 1
 
 const TraceIdKey = "trace_id"
+const CallerKey = "caller" // 调用方的应用名，服务端用于按调用方限流
 
 type MetaData struct {
 	Owner string
@@ -34,6 +43,17 @@ type MetaDataInner struct {
 	Lang   string
 	Pid    int
 	User   string // 启动服务的用户名
+	TLS    int    // 1 表示实例要求 TLS，客户端根据此值选择是否使用 TLS 连接
+}
+
+// TLSConfig TLS 证书配置，证书、私钥和 CA 文件修改之后自动重新加载
+type TLSConfig struct {
+	Enable            bool   `yaml:"enable"`            // client 端所有的连接都使用 TLS，为 false 时只对 metadata 中 tls=1 的实例使用 TLS；server 端设置 certFile 即开启
+	CertFile          string `yaml:"certFile"`          // PEM 格式的证书，client 端用于 mTLS
+	KeyFile           string `yaml:"keyFile"`           // PEM 格式的私钥
+	CAFile            string `yaml:"caFile"`            // server 端用于验证客户端证书，client 端用于验证服务端证书，为空时使用系统的 CA
+	ServerName        string `yaml:"serverName"`        // client 端验证服务端证书时使用的名称，为空时使用实例的 ip
+	RequireClientCert bool   `yaml:"requireClientCert"` // server 端是否要求客户端证书（mTLS）
 }
 
 var DefaultMetaDataInner = MetaDataInner{
@@ -43,5 +63,60 @@ var DefaultMetaDataInner = MetaDataInner{
 }
 
 func (m MetaDataInner) String() string {
-	return fmt.Sprintf("weight=%d&active=%d&owner=%s&lang=%s&pid=%d&user=%s", m.Weight, m.Active, m.Owner, m.Lang, m.Pid, m.User)
+	return fmt.Sprintf("weight=%d&active=%d&owner=%s&lang=%s&pid=%d&user=%s&tls=%d", m.Weight, m.Active, m.Owner, m.Lang, m.Pid, m.User, m.TLS)
+}
+
+// Online 实例是否在线，下线（active=1）的实例不参与负载均衡
+func (m MetaDataInner) Online() bool {
+	return m.Active != MetaActiveOffline
+}
+
+// ParseMetaDataInner 解析 MetaDataInner.String() 格式的字符串，缺少的字段使用 DefaultMetaDataInner 中的值
+// 格式错误的字段使用默认值并返回错误
+func ParseMetaDataInner(s string) (MetaDataInner, error) {
+	m := DefaultMetaDataInner
+	var err error
+	for _, item := range strings.Split(s, "&") {
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("metadata item[%s] format invalid", item)
+			continue
+		}
+		switch kv[0] {
+		case "weight":
+			if w, e := strconv.Atoi(kv[1]); e != nil || w < 0 {
+				err = fmt.Errorf("metadata weight[%s] invalid", kv[1])
+			} else {
+				m.Weight = w
+			}
+		case "active":
+			if a, e := strconv.Atoi(kv[1]); e != nil {
+				err = fmt.Errorf("metadata active[%s] invalid", kv[1])
+			} else {
+				m.Active = a
+			}
+		case "pid":
+			if p, e := strconv.Atoi(kv[1]); e != nil {
+				err = fmt.Errorf("metadata pid[%s] invalid", kv[1])
+			} else {
+				m.Pid = p
+			}
+		case "tls":
+			if t, e := strconv.Atoi(kv[1]); e != nil {
+				err = fmt.Errorf("metadata tls[%s] invalid", kv[1])
+			} else {
+				m.TLS = t
+			}
+		case "owner":
+			m.Owner = kv[1]
+		case "lang":
+			m.Lang = kv[1]
+		case "user":
+			m.User = kv[1]
+		}
+	}
+	return m, err
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 	"openWebSF/example/pb"
 	"openWebSF/example/server/service"
+	"openWebSF/interceptor/trace"
 	"openWebSF/server"
 )
 
@@ -19,7 +23,9 @@ func main() {
 	flag.Parse()
 	switch *serverType {
 	case "shutdown":
-		return
+		shutdownServer()
+	case "interceptor":
+		interceptorServer()
 	default:
 		simpleServer()
 	}
@@ -31,7 +37,50 @@ func simpleServer() {
 		RegisterService: pb.RegisterHelloServiceServer,
 		Server:   &service.HelloServer{},
 	}
-	server.NewServer().
+	if err := server.NewServer().
 		Register(helloService).
-		Start(*port)
-}
\ No newline at end of file
+		Start(*port); err != nil {
+		logrus.Fatalln(err)
+	}
+}
+
+// shutdownServer 退出时执行 hook，kill -TERM <pid> 或者调用管理接口的 /shutdown 触发
+func shutdownServer() {
+	helloService := server.ServiceConfig{
+		Name:    *service1,
+		RegisterService: pb.RegisterHelloServiceServer,
+		Server:   &service.HelloServer{},
+	}
+	if err := server.NewServer().
+		AddShutdownHook(func(ctx context.Context) error {
+			logrus.Infoln("release resources before exit")
+			return nil
+		}).
+		Register(helloService).
+		Start(*port); err != nil {
+		logrus.Fatalln(err)
+	}
+}
+
+// interceptorServer 添加所有服务共用的和只对 helloService 生效的 interceptor
+func interceptorServer() {
+	helloService := server.ServiceConfig{
+		Name:    *service1,
+		RegisterService: pb.RegisterHelloServiceServer,
+		Server:   &service.HelloServer{},
+	}
+	helloService.AddUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		logrus.Infof("hello service request, trace id: %s", trace.FromContext(ctx))
+		return handler(ctx, req)
+	})
+	if err := server.NewServer().
+		AddUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			resp, err := handler(ctx, req)
+			logrus.Infof("access %s, error: %v", info.FullMethod, err)
+			return resp, err
+		}).
+		Register(helloService).
+		Start(*port); err != nil {
+		logrus.Fatalln(err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/peer"
+	"openWebSF/interceptor/trace"
 )
 
 const logTimePattern = "2006-01-02 15:04:05.000"
@@ -56,9 +57,63 @@ func StreamMonitorLog(threshold time.Duration) grpc.StreamClientInterceptor {
 	}
 }
 
+// UnaryServerMonitorLog 服务端处理请求的耗时大于等于 threshold 时记录 monitor 日志
+func UnaryServerMonitorLog(threshold time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		startTime := time.Now()
+		resp, err := handler(ctx, req)
+		printServerMonitorLog(ctx, threshold, startTime, info.FullMethod, req)
+		return resp, err
+	}
+}
+
+// StreamServerMonitorLog stream 结束时根据整个 stream 的耗时记录 monitor 日志
+func StreamServerMonitorLog(threshold time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		startTime := time.Now()
+		err := handler(srv, ss)
+		printServerMonitorLog(ss.Context(), threshold, startTime, info.FullMethod, nil)
+		return err
+	}
+}
+
+func printServerMonitorLog(ctx context.Context, threshold time.Duration, startTime time.Time, method string, req interface{}) {
+	var addr net.Addr
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr
+	}
+	printLog(threshold, startTime, trace.FromContext(ctx), method, req, addr)
+}
+
+// PrintLimitLog 服务端因为限流拒绝请求时记录 monitor 日志
+func PrintLimitLog(method string, caller string, peerAdr net.Addr, reason string) {
+	if logger == nil {
+		return
+	}
+	addr := "-"
+	if peerAdr != nil {
+		addr = peerAdr.String()
+	}
+	if caller == "" {
+		caller = "-"
+	}
+	logger.Printf("%s - - grpc limited grpc://%s%s caller=%s %s\n", time.Now().Format(logTimePattern), addr, method, caller, reason)
+}
+
 func printMonitorLog(threshold time.Duration, startTime time.Time, method string, req interface{}, peerAdr net.Addr) {
+	printLog(threshold, startTime, "", method, req, peerAdr)
+}
+
+// printLog traceId 为空时记录为 -
+func printLog(threshold time.Duration, startTime time.Time, traceId string, method string, req interface{}, peerAdr net.Addr) {
+	if logger == nil {
+		return
+	}
 	cost := time.Since(startTime)
 	if cost >= threshold {
+		if traceId == "" {
+			traceId = "-"
+		}
 		addr := "-"
 		if peerAdr != nil {
 			addr = peerAdr.String()
@@ -73,6 +128,6 @@ func printMonitorLog(threshold time.Duration, startTime time.Time, method string
 			reqBytes = append(reqBytes, msg...)
 		}
 		costMs := cost / time.Millisecond
-		logger.Printf("%s - - grpc %d ms grpc://%s%s %s\n", time.Now().Format(logTimePattern), costMs, addr, method, string(reqBytes))
+		logger.Printf("%s %s - grpc %d ms grpc://%s%s %s\n", time.Now().Format(logTimePattern), traceId, costMs, addr, method, string(reqBytes))
 	}
 }
@@ -18,6 +18,20 @@ func UnaryPass(keys ...string) grpc.UnaryClientInterceptor {
 	}
 }
 
+// StreamAppend 在 outgoing metadata 中添加固定的 key/value，例如调用方的应用名
+func StreamAppend(kv ...string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(metadata.AppendToOutgoingContext(ctx, kv...), desc, cc, method, opts...)
+	}
+}
+
+// UnaryAppend 在 outgoing metadata 中添加固定的 key/value，例如调用方的应用名
+func UnaryAppend(kv ...string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, kv...), method, req, reply, cc, opts...)
+	}
+}
+
 // 将 incoming 中的指定的 metadata 复制到 outgoing 中
 func newOutIncomingMetadata(ctx context.Context, keys ...string) context.Context {
 	newCtx := ctx
@@ -31,4 +45,4 @@ func newOutIncomingMetadata(ctx context.Context, keys ...string) context.Context
 		}
 	}
 	return newCtx
-}
\ No newline at end of file
+}
@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"openWebSF/interceptor/monitor"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAdaptiveInitLimit = 20
+	DefaultAdaptiveMinLimit  = 5
+	DefaultAdaptiveMaxLimit  = 1000
+
+	// 每个采样窗口至少持续 adaptiveWindow 并且包含 adaptiveMinSamples 个请求，窗口结束时调整一次上限
+	adaptiveWindow     = 100 * time.Millisecond
+	adaptiveMinSamples = 10
+	// 窗口耗时超过无负载耗时的 adaptiveTolerance 倍时才减小上限
+	adaptiveTolerance = 1.5
+	// 无负载耗时每个窗口上升的比例，业务本身的耗时变长之后（例如依赖的服务变慢）逐渐适应，大约 100s 上升到 2.7 倍
+	adaptiveMinRTTDrift = 0.001
+	// 新的上限与当前上限的加权系数，避免上限剧烈波动
+	adaptiveSmoothing = 0.2
+)
+
+// AdaptiveLimiter 自适应的并发限制（gradient 算法），根据请求耗时动态调整允许同时处理的请求数：
+// 窗口内的平均耗时接近无负载耗时（窗口平均耗时的最小值）时逐步增加上限，耗时明显变长（排队）时按 无负载耗时 / 窗口耗时 的比例减小上限，
+// 超过上限的请求直接返回 codes.Unavailable，避免请求堆积导致耗时持续恶化
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	enable   bool
+	limit    float64
+	minLimit float64
+	maxLimit float64
+	inflight int
+	rejected uint64
+
+	minRTT time.Duration // 无负载耗时
+	rtt    time.Duration // 最近一个窗口的平均耗时
+
+	windowStart       time.Time
+	windowSum         time.Duration
+	windowCount       int
+	windowMaxInflight int
+}
+
+// AdaptiveStatus 自适应并发限制的状态
+type AdaptiveStatus struct {
+	Enable   bool   `json:"enable"`
+	Limit    int    `json:"limit"`
+	MinLimit int    `json:"min_limit"`
+	MaxLimit int    `json:"max_limit"`
+	Inflight int    `json:"inflight"`
+	MinRTT   string `json:"min_rtt"`
+	RTT      string `json:"rtt"`
+	Rejected uint64 `json:"rejected"` // 启动以来拒绝的请求数
+}
+
+// NewAdaptiveLimiter 参数小于等于 0 时使用默认值
+func NewAdaptiveLimiter(enable bool, initLimit, minLimit, maxLimit int) *AdaptiveLimiter {
+	l := &AdaptiveLimiter{}
+	l.Update(enable, initLimit, minLimit, maxLimit)
+	return l
+}
+
+// Update 修改配置，可以在运行时调用，已经开启时保留当前的上限（限制在新的范围内），从关闭变为开启时使用 initLimit
+func (l *AdaptiveLimiter) Update(enable bool, initLimit, minLimit, maxLimit int) {
+	if minLimit <= 0 {
+		minLimit = DefaultAdaptiveMinLimit
+	}
+	if maxLimit <= 0 {
+		maxLimit = DefaultAdaptiveMaxLimit
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	if initLimit <= 0 {
+		initLimit = DefaultAdaptiveInitLimit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if enable && !l.enable {
+		l.limit = float64(initLimit)
+		l.minRTT, l.rtt = 0, 0
+		l.resetWindow(time.Now())
+	}
+	l.enable = enable
+	l.minLimit = float64(minLimit)
+	l.maxLimit = float64(maxLimit)
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+}
+
+// Status 返回当前的状态
+func (l *AdaptiveLimiter) Status() AdaptiveStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return AdaptiveStatus{
+		Enable:   l.enable,
+		Limit:    int(l.limit),
+		MinLimit: int(l.minLimit),
+		MaxLimit: int(l.maxLimit),
+		Inflight: l.inflight,
+		MinRTT:   l.minRTT.String(),
+		RTT:      l.rtt.String(),
+		Rejected: l.rejected,
+	}
+}
+
+// acquire 没有超过上限时返回请求结束之后需要调用的函数，超过上限时返回 false
+func (l *AdaptiveLimiter) acquire() (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enable {
+		return func() {}, true
+	}
+	if l.inflight >= int(l.limit) {
+		l.rejected++
+		return nil, false
+	}
+	l.inflight++
+	if l.inflight > l.windowMaxInflight {
+		l.windowMaxInflight = l.inflight
+	}
+	start := time.Now()
+	return func() {
+		l.release(start)
+	}, true
+}
+
+func (l *AdaptiveLimiter) release(start time.Time) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	if !l.enable {
+		return
+	}
+	l.windowSum += now.Sub(start)
+	l.windowCount++
+	if now.Sub(l.windowStart) < adaptiveWindow || l.windowCount < adaptiveMinSamples {
+		return
+	}
+	l.adjust(l.windowSum / time.Duration(l.windowCount))
+	l.resetWindow(now)
+}
+
+// adjust 根据窗口内的平均耗时调整上限，调用时必须持有 l.mu
+func (l *AdaptiveLimiter) adjust(rtt time.Duration) {
+	if rtt <= 0 {
+		rtt = time.Microsecond
+	}
+	l.rtt = rtt
+	if minRTT := time.Duration(float64(l.minRTT) * (1 + adaptiveMinRTTDrift)); l.minRTT == 0 || rtt < minRTT {
+		l.minRTT = rtt
+	} else {
+		l.minRTT = minRTT
+	}
+
+	limit := l.limit
+	if gradient := adaptiveTolerance * float64(l.minRTT) / float64(rtt); gradient < 1 {
+		// 开始排队，按比例减小上限，每次最多减小一半
+		limit = l.limit * math.Max(0.5, gradient)
+	} else if float64(l.windowMaxInflight) >= l.limit/2 {
+		// 没有排队并且并发数达到上限的一半时才增加上限，请求量不足时上限不能说明服务的处理能力
+		limit = l.limit + math.Sqrt(l.limit)
+	}
+	limit = l.limit*(1-adaptiveSmoothing) + limit*adaptiveSmoothing
+	limit = math.Min(math.Max(limit, l.minLimit), l.maxLimit)
+	if int(limit) != int(l.limit) {
+		logrus.Debugf("adaptive concurrency limit %d -> %d, rtt: %s, min rtt: %s", int(l.limit), int(limit), rtt, l.minRTT)
+	}
+	l.limit = limit
+}
+
+// resetWindow 调用时必须持有 l.mu
+func (l *AdaptiveLimiter) resetWindow(now time.Time) {
+	l.windowStart = now
+	l.windowSum = 0
+	l.windowCount = 0
+	l.windowMaxInflight = l.inflight
+}
+
+// AdaptiveUnaryServerInterceptor 超过并发上限的请求返回 codes.Unavailable，客户端可以重试其它实例
+// stream 的持续时间与负载无关，不受自适应并发限制
+func AdaptiveUnaryServerInterceptor(l *AdaptiveLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(ctx, req)
+		}
+		done, ok := l.acquire()
+		if !ok {
+			limit := l.Status().Limit
+			var addr net.Addr
+			if p, ok := peer.FromContext(ctx); ok {
+				addr = p.Addr
+			}
+			monitor.PrintLimitLog(info.FullMethod, Caller(ctx), addr, "adaptive concurrency limit "+strconv.Itoa(limit))
+			return nil, status.Errorf(codes.Unavailable, "%s rejected, exceed adaptive concurrency limit %d", info.FullMethod, limit)
+		}
+		defer done()
+		return handler(ctx, req)
+	}
+}
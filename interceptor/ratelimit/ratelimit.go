@@ -0,0 +1,312 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"openWebSF/config"
+	"openWebSF/interceptor/monitor"
+	"openWebSF/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// health check 不限流，避免服务繁忙时被注册中心（例如 consul）判定为不健康
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// Limiter 令牌桶限流，每秒产生 qps 个令牌，桶的容量为 qps，qps <= 0 时不限流
+type Limiter struct {
+	mu     sync.Mutex
+	qps    int
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(qps int) *Limiter {
+	l := &Limiter{}
+	l.SetQPS(qps)
+	return l
+}
+
+// SetQPS 修改 QPS 上限，可以在运行时调用，例如收到 SIGUSR1 重新加载配置时
+func (l *Limiter) SetQPS(qps int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if qps < 0 {
+		qps = 0
+	}
+	l.qps = qps
+	l.tokens = float64(qps)
+	l.last = time.Now()
+}
+
+// QPS 返回当前的 QPS 上限，0 表示不限流
+func (l *Limiter) QPS() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.qps
+}
+
+// Allow 取一个令牌，没有令牌时返回 false
+func (l *Limiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.qps <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.qps)
+	if l.tokens > float64(l.qps) {
+		l.tokens = float64(l.qps)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Limiters 全局、按方法、按调用方和集群的限流，一个请求需要同时满足所有的限制
+type Limiters struct {
+	global    *Limiter
+	mu        sync.RWMutex
+	methods   map[string]*Limiter // key 为完整的方法名，例如 /ofo.user.v1.userService/QueryUserByToken
+	folded    map[string]*Limiter // key 为小写的方法名，方法名不区分大小写
+	callers   map[string]*Limiter // key 为调用方的应用名，从 metadata 的 config.CallerKey 中获取
+	cluster   map[string]*clusterLimit
+	instances map[string]int    // 注册中心中服务的实例数，key 为服务名
+	services  map[string]string // key 为 .proto 中的服务名，value 为集群限流使用的服务名，没有时直接使用 .proto 中的服务名
+}
+
+// clusterLimit 集群限流，budget 为服务所有实例的 QPS 上限之和，本实例的上限为 budget / 实例数
+type clusterLimit struct {
+	budget  int
+	limiter *Limiter
+}
+
+// ClusterStatus 集群限流的状态
+type ClusterStatus struct {
+	Budget    int `json:"budget"`
+	Instances int `json:"instances"`
+	QPS       int `json:"qps"` // 本实例的份额
+}
+
+func NewLimiters(qps int, methods map[string]int, callers map[string]int) *Limiters {
+	l := &Limiters{
+		global: NewLimiter(qps),
+	}
+	l.Update(qps, methods, callers)
+	return l
+}
+
+// Update 修改所有的限制，QPS 上限没有变化的令牌桶保留当前的令牌
+func (l *Limiters) Update(qps int, methods map[string]int, callers map[string]int) {
+	if l.global.QPS() != qps {
+		l.global.SetQPS(qps)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.methods = update(l.methods, methods)
+	l.folded = make(map[string]*Limiter, len(l.methods))
+	for key, limiter := range l.methods {
+		l.folded[strings.ToLower(key)] = limiter
+	}
+	l.callers = update(l.callers, callers)
+}
+
+func update(old map[string]*Limiter, conf map[string]int) map[string]*Limiter {
+	limiters := make(map[string]*Limiter, len(conf))
+	for key, qps := range conf {
+		if qps <= 0 {
+			continue
+		}
+		if limiter, ok := old[key]; ok {
+			if limiter.QPS() != qps {
+				limiter.SetQPS(qps)
+			}
+			limiters[key] = limiter
+		} else {
+			limiters[key] = NewLimiter(qps)
+		}
+	}
+	return limiters
+}
+
+// UpdateCluster 修改集群限流的总 QPS，key 为服务名
+func (l *Limiters) UpdateCluster(budgets map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cluster := make(map[string]*clusterLimit, len(budgets))
+	for service, budget := range budgets {
+		if budget <= 0 {
+			continue
+		}
+		c, ok := l.cluster[service]
+		if !ok {
+			c = &clusterLimit{limiter: NewLimiter(0)}
+		}
+		c.budget = budget
+		cluster[service] = c
+	}
+	l.cluster = cluster
+	for service := range cluster {
+		l.rebalance(service)
+	}
+}
+
+// SetServices 设置 .proto 中的服务名到服务名的映射，请求按映射之后的服务名匹配集群限流
+func (l *Limiters) SetServices(services map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.services = services
+}
+
+// SetInstances 服务的实例数变化时重新计算本实例的份额
+func (l *Limiters) SetInstances(service string, instances int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.instances == nil {
+		l.instances = make(map[string]int)
+	}
+	l.instances[service] = instances
+	l.rebalance(service)
+}
+
+// rebalance 调用时必须持有 l.mu，实例数未知或者为 0（本实例尚未注册）时按 1 个实例计算
+func (l *Limiters) rebalance(service string) {
+	c, ok := l.cluster[service]
+	if !ok {
+		return
+	}
+	n := l.instances[service]
+	if n < 1 {
+		n = 1
+	}
+	if share := (c.budget + n - 1) / n; c.limiter.QPS() != share {
+		c.limiter.SetQPS(share)
+	}
+}
+
+// Cluster 返回集群限流的状态，key 为服务名
+func (l *Limiters) Cluster() map[string]ClusterStatus {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	m := make(map[string]ClusterStatus, len(l.cluster))
+	for service, c := range l.cluster {
+		m[service] = ClusterStatus{
+			Budget:    c.budget,
+			Instances: l.instances[service],
+			QPS:       c.limiter.QPS(),
+		}
+	}
+	return m
+}
+
+// QPS 返回全局的 QPS 上限
+func (l *Limiters) QPS() int {
+	return l.global.QPS()
+}
+
+// Methods 返回按方法的 QPS 上限
+func (l *Limiters) Methods() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return limits(l.methods)
+}
+
+// Callers 返回按调用方的 QPS 上限
+func (l *Limiters) Callers() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return limits(l.callers)
+}
+
+func limits(limiters map[string]*Limiter) map[string]int {
+	m := make(map[string]int, len(limiters))
+	for key, limiter := range limiters {
+		m[key] = limiter.QPS()
+	}
+	return m
+}
+
+func (l *Limiters) check(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return nil
+	}
+	caller := Caller(ctx)
+	l.mu.RLock()
+	methodLimiter := l.methods[method]
+	if methodLimiter == nil && len(l.folded) > 0 {
+		// 生成的代码中 FullMethod 的方法名与 .proto 中的大小写可能不同
+		methodLimiter = l.folded[strings.ToLower(method)]
+	}
+	callerLimiter := l.callers[caller]
+	var clusterLimiter *Limiter
+	service := utils.MethodService(method)
+	if name, ok := l.services[service]; ok {
+		service = name
+	}
+	if c, ok := l.cluster[service]; ok {
+		clusterLimiter = c.limiter
+	}
+	l.mu.RUnlock()
+
+	var reason string
+	var qps int
+	switch {
+	case methodLimiter != nil && !methodLimiter.Allow():
+		reason, qps = "method", methodLimiter.QPS()
+	case callerLimiter != nil && !callerLimiter.Allow():
+		reason, qps = "caller", callerLimiter.QPS()
+	case clusterLimiter != nil && !clusterLimiter.Allow():
+		reason, qps = "cluster", clusterLimiter.QPS()
+	case !l.global.Allow():
+		reason, qps = "global", l.global.QPS()
+	default:
+		return nil
+	}
+
+	var addr net.Addr
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr
+	}
+	monitor.PrintLimitLog(method, caller, addr, fmt.Sprintf("%s qps limit %d", reason, qps))
+	return status.Errorf(codes.ResourceExhausted, "%s rejected, exceed %s qps limit %d", method, reason, qps)
+}
+
+// Caller 返回 metadata 中调用方的应用名，没有时返回空字符串
+func Caller(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(config.CallerKey); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// UnaryServerInterceptor 超过 QPS 上限的请求返回 codes.ResourceExhausted
+func UnaryServerInterceptor(l *Limiters) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := l.check(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor 每个 stream 消耗一个令牌
+func StreamServerInterceptor(l *Limiters) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := l.check(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
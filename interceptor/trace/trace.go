@@ -0,0 +1,64 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"openWebSF/config"
+)
+
+// NewTraceId 生成 16 字节随机数的 hex 字符串
+func NewTraceId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// FromContext 返回请求的 trace id，没有时返回空字符串
+func FromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(config.TraceIdKey); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// withTraceId 请求的 incoming metadata 中没有 trace id 时生成一个新的，
+// 服务中使用 client 调用下游服务时通过 pass_metadata 将 incoming 中的 trace id 传给下游
+func withTraceId(ctx context.Context) context.Context {
+	if FromContext(ctx) != "" {
+		return ctx
+	}
+	traceId := NewTraceId()
+	if traceId == "" {
+		return ctx
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md.Set(config.TraceIdKey, traceId)
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withTraceId(ctx), req)
+	}
+}
+
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = withTraceId(ss.Context())
+		return handler(srv, wrapped)
+	}
+}
@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"openWebSF/config"
+	"openWebSF/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	consulScheme = "consul"
+
+	consulTagOwsf    = "owsf"
+	consulTagOnline  = "online"
+	consulTagOffline = "offline"
+
+	// consul 通过 grpc health check 判断实例是否存活，连续失败超过 consulDeregisterAfter 之后 consul 删除该实例
+	consulCheckInterval   = "5s"
+	consulCheckTimeout    = "3s"
+	consulDeregisterAfter = "1m"
+
+	// blocking query 的最长等待时间
+	consulWaitTime = 5 * time.Minute
+	// 访问 consul 失败之后重试的间隔
+	consulRetryInterval = 3 * time.Second
+)
+
+func init() {
+	AddBackend(consulScheme, newConsulRegistry)
+}
+
+// consulRegistry 基于 consul catalog 的注册中心实现
+// 服务注册到 consul agent，MetaDataInner 映射为 service meta，group 和 active 映射为 tag
+type consulRegistry struct {
+	sync.Mutex
+	client *api.Client
+	done   chan struct{}
+	once   sync.Once
+	// health check 使用 TLS 时不验证服务端证书
+	tlsSkipVerify bool
+}
+
+// newConsulRegistry addr 格式为 consul://127.0.0.1:8500
+// 服务端开启 TLS 时 consul agent 使用 TLS 做 health check，证书由 agent 没有配置的私有 CA 签发时
+// 需要使用 consul://127.0.0.1:8500?tlsSkipVerify=true 跳过证书验证；
+// mTLS 时 agent 使用自己的证书（cert_file、key_file）做 health check，该证书需要由服务端的 caFile 签发
+func newConsulRegistry(addr string) (Registry, error) {
+	servers := utils.RegistryServers(addr)
+	query := ""
+	if i := strings.Index(servers, "?"); i >= 0 {
+		servers, query = servers[:i], servers[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("consul address %s invalid, error: %v", addr, err)
+	}
+	tlsSkipVerify := false
+	if v := params.Get("tlsSkipVerify"); v != "" {
+		if tlsSkipVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("consul address %s: tlsSkipVerify invalid", addr)
+		}
+	}
+	cfg := api.DefaultConfig()
+	if servers != "" {
+		// consul agent 只需要连接一个地址
+		cfg.Address = strings.Split(servers, ",")[0]
+	}
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &consulRegistry{
+		client:        client,
+		done:          make(chan struct{}),
+		tlsSkipVerify: tlsSkipVerify,
+	}, nil
+}
+
+func (r *consulRegistry) RegisterService(serviceName string, port int, metadata config.MetaDataInner, groups ...string) error {
+	r.Lock()
+	defer r.Unlock()
+	addr := net.JoinHostPort(config.Default.LocalIP, strconv.Itoa(port))
+	registration := &api.AgentServiceRegistration{
+		ID:      consulServiceID(serviceName, addr, groups...),
+		Name:    serviceName,
+		Address: config.Default.LocalIP,
+		Port:    port,
+		Tags:    consulTags(metadata, groups...),
+		Meta:    consulMeta(metadata),
+		Check: &api.AgentServiceCheck{
+			// 格式为 addr/service，只检查该服务的状态，服务下线（health 为 NOT_SERVING）时 check 失败
+			GRPC:                           addr + "/" + serviceName,
+			GRPCUseTLS:                     metadata.TLS == config.MetaTLS,
+			TLSSkipVerify:                  r.tlsSkipVerify,
+			Interval:                       consulCheckInterval,
+			Timeout:                        consulCheckTimeout,
+			DeregisterCriticalServiceAfter: consulDeregisterAfter,
+		},
+	}
+	if err := r.client.Agent().ServiceRegister(registration); err != nil {
+		return err
+	}
+	logrus.Infof("register [%s] to consul success", registration.ID)
+	return nil
+}
+
+func (r *consulRegistry) UnRegisterService(serviceName string, port int, groups ...string) error {
+	r.Lock()
+	defer r.Unlock()
+	id := consulServiceID(serviceName, net.JoinHostPort(config.Default.LocalIP, strconv.Itoa(port)), groups...)
+	if err := r.client.Agent().ServiceDeregister(id); err != nil {
+		return err
+	}
+	logrus.Infof("unregister [%s] from consul success", id)
+	return nil
+}
+
+// RegisterClient consul catalog 中只有服务端，客户端信息写到 consul kv 中
+func (r *consulRegistry) RegisterClient(serviceName string, pid int, groups ...string) error {
+	pair := &api.KVPair{
+		Key:   utils.ClientKey(serviceName, groups...),
+		Value: []byte(fmt.Sprintf("%d", pid)),
+	}
+	_, err := r.client.KV().Put(pair, nil)
+	return err
+}
+
+func (r *consulRegistry) UnRegisterClient(serviceName string, groups ...string) error {
+	_, err := r.client.KV().Delete(utils.ClientKey(serviceName, groups...), nil)
+	return err
+}
+
+// List 只返回 consul health check 通过的实例
+func (r *consulRegistry) List(serviceName string, groups ...string) ([]*Endpoint, error) {
+	endpoints, _, err := r.health(context.Background(), serviceName, 0, groups...)
+	return endpoints, err
+}
+
+func (r *consulRegistry) Watch(serviceName string, stopCh <-chan struct{}, groups ...string) (<-chan []*Endpoint, error) {
+	endpoints, index, err := r.health(context.Background(), serviceName, 0, groups...)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []*Endpoint)
+	go func() {
+		defer close(ch)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stopCh:
+			case <-r.done:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+
+		for {
+			select {
+			case ch <- endpoints:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				current, newIndex, err := r.health(ctx, serviceName, index, groups...)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					logrus.Warnf("consul watch service[%s] failed, error: %v", serviceName, err)
+					select {
+					case <-time.After(consulRetryInterval):
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				if newIndex < index {
+					// consul 的 index 回退时需要重新开始 blocking query
+					newIndex = 0
+				}
+				changed := newIndex != index
+				index, endpoints = newIndex, current
+				if changed {
+					break
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *consulRegistry) Close() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+// health 查询 consul 中健康的实例，index 大于 0 时为 blocking query
+func (r *consulRegistry) health(ctx context.Context, serviceName string, index uint64, groups ...string) ([]*Endpoint, uint64, error) {
+	q := &api.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  consulWaitTime,
+	}
+	entries, meta, err := r.client.Health().Service(serviceName, consulGroupTag(groups...), true, q.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	endpoints := make([]*Endpoint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Service == nil {
+			continue
+		}
+		host := entry.Service.Address
+		if host == "" && entry.Node != nil {
+			host = entry.Node.Address
+		}
+		endpoints = append(endpoints, &Endpoint{
+			Addr:     net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Metadata: consulMetaDataInner(entry.Service.Meta).String(),
+		})
+	}
+	return endpoints, meta.LastIndex, nil
+}
+
+// consulServiceID 同一个实例可以注册到多个分组，非默认分组的 ID 中包含分组名
+func consulServiceID(serviceName string, addr string, groups ...string) string {
+	if len(groups) == 1 && groups[0] != config.Default.Group {
+		return fmt.Sprintf("%s-%s-%s", serviceName, groups[0], addr)
+	}
+	return fmt.Sprintf("%s-%s", serviceName, addr)
+}
+
+func consulGroupTag(groups ...string) string {
+	group := config.Default.Group
+	if len(groups) == 1 {
+		group = groups[0]
+	}
+	return "group=" + group
+}
+
+func consulTags(metadata config.MetaDataInner, groups ...string) []string {
+	active := consulTagOnline
+	if metadata.Active == config.MetaActiveOffline {
+		active = consulTagOffline
+	}
+	return []string{consulTagOwsf, consulGroupTag(groups...), active}
+}
+
+func consulMeta(metadata config.MetaDataInner) map[string]string {
+	return map[string]string{
+		"weight": strconv.Itoa(metadata.Weight),
+		"active": strconv.Itoa(metadata.Active),
+		"owner":  metadata.Owner,
+		"lang":   metadata.Lang,
+		"pid":    strconv.Itoa(metadata.Pid),
+		"user":   metadata.User,
+		"tls":    strconv.Itoa(metadata.TLS),
+	}
+}
+
+func consulMetaDataInner(meta map[string]string) config.MetaDataInner {
+	metadata := config.DefaultMetaDataInner
+	if v, err := strconv.Atoi(meta["weight"]); err == nil {
+		metadata.Weight = v
+	}
+	if v, err := strconv.Atoi(meta["active"]); err == nil {
+		metadata.Active = v
+	}
+	if v, err := strconv.Atoi(meta["pid"]); err == nil {
+		metadata.Pid = v
+	}
+	if v, err := strconv.Atoi(meta["tls"]); err == nil {
+		metadata.TLS = v
+	}
+	if v, ok := meta["lang"]; ok {
+		metadata.Lang = v
+	}
+	metadata.Owner = meta["owner"]
+	metadata.User = meta["user"]
+	return metadata
+}
@@ -0,0 +1,367 @@
+package registry
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"openWebSF/config"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul 模拟 consul agent 的注册、health 和 kv 接口，所有注册的实例都认为 health check 通过
+type fakeConsul struct {
+	*httptest.Server
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{} // index 变化时关闭，唤醒 blocking query
+	services map[string]*api.AgentServiceRegistration
+	kv       map[string]string
+	indexes  []uint64 // health 接口收到的 index，不是 blocking query 时为 0
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]*api.AgentServiceRegistration),
+		kv:       make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", f.register)
+	mux.HandleFunc("/v1/agent/service/deregister/", f.deregister)
+	mux.HandleFunc("/v1/health/service/", f.health)
+	mux.HandleFunc("/v1/kv/", f.kvHandler)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeConsul) addr() string {
+	return consulScheme + "://" + strings.TrimPrefix(f.URL, "http://")
+}
+
+// setIndex 修改 index 并唤醒 blocking query，index 小于当前值时模拟 consul 重启之后 index 回退
+func (f *fakeConsul) setIndex(index uint64) {
+	f.index = index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) register(w http.ResponseWriter, r *http.Request) {
+	var registration api.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.services[registration.ID] = &registration
+	f.setIndex(f.index + 1)
+	f.mu.Unlock()
+}
+
+func (f *fakeConsul) deregister(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.services[id]; !ok {
+		http.Error(w, "unknown service ID: "+id, http.StatusNotFound)
+		return
+	}
+	delete(f.services, id)
+	f.setIndex(f.index + 1)
+}
+
+func (f *fakeConsul) health(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	query := r.URL.Query()
+	index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+
+	f.mu.Lock()
+	f.indexes = append(f.indexes, index)
+	// blocking query 等待 index 变化，测试中最多等待 1s
+	if index > 0 && index == f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		f.mu.Lock()
+	}
+	entries := make([]*api.ServiceEntry, 0)
+	for _, s := range f.services {
+		if s.Name != name || !hasTags(s.Tags, query["tag"]) {
+			continue
+		}
+		entries = append(entries, &api.ServiceEntry{
+			Node: &api.Node{Node: "node", Address: "10.0.0.1"},
+			Service: &api.AgentService{
+				ID:      s.ID,
+				Service: s.Name,
+				Tags:    s.Tags,
+				Meta:    s.Meta,
+				Port:    s.Port,
+				Address: s.Address,
+			},
+		})
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (f *fakeConsul) kvHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(r.Body)
+		f.kv[key] = string(value)
+	case http.MethodDelete:
+		delete(f.kv, key)
+	}
+	w.Write([]byte("true"))
+}
+
+func hasTags(tags []string, want []string) bool {
+	for _, tag := range want {
+		found := false
+		for _, t := range tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestConsulRegistry(t *testing.T) (*fakeConsul, Registry) {
+	config.Default.LocalIP = "127.0.0.1"
+	f := newFakeConsul()
+	r, err := newConsulRegistry(f.addr())
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f, r
+}
+
+func TestConsulMetaRoundTrip(t *testing.T) {
+	custom := config.MetaDataInner{
+		MetaData: config.MetaData{Owner: "owner"},
+		Weight:   50,
+		Active:   config.MetaActiveOffline,
+		Lang:     "go",
+		Pid:      1234,
+		User:     "user",
+		TLS:      config.MetaTLS,
+	}
+	tests := []struct {
+		name string
+		meta map[string]string
+		want config.MetaDataInner
+	}{
+		{name: "default", meta: consulMeta(config.DefaultMetaDataInner), want: config.DefaultMetaDataInner},
+		{name: "custom", meta: consulMeta(custom), want: custom},
+		{name: "missing keys use default", meta: map[string]string{}, want: config.DefaultMetaDataInner},
+		{name: "invalid number uses default", meta: map[string]string{"weight": "x", "tls": "1"}, want: func() config.MetaDataInner {
+			m := config.DefaultMetaDataInner
+			m.TLS = config.MetaTLS
+			return m
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := consulMetaDataInner(tt.meta)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("consulMetaDataInner() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsulRegisterGroups(t *testing.T) {
+	f, r := newTestConsulRegistry(t)
+	defer f.Close()
+	defer r.Close()
+
+	meta := config.DefaultMetaDataInner
+	meta.Weight = 50
+	if err := r.RegisterService("svc", 9301, meta, config.Default.Group); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterService("svc", 9302, meta, "bj"); err != nil {
+		t.Fatal(err)
+	}
+
+	registration := f.services["svc-127.0.0.1:9301"]
+	if registration == nil {
+		t.Fatalf("service not registered, services: %v", f.services)
+	}
+	wantTags := []string{consulTagOwsf, "group=" + config.Default.Group, consulTagOnline}
+	if !reflect.DeepEqual(registration.Tags, wantTags) || registration.Check.GRPC != "127.0.0.1:9301/svc" || registration.Check.TLSSkipVerify {
+		t.Fatalf("registration = %+v, check = %+v", registration, registration.Check)
+	}
+	if f.services["svc-bj-127.0.0.1:9302"] == nil {
+		t.Fatalf("service of group bj not registered, services: %v", f.services)
+	}
+
+	tests := []struct {
+		group string
+		want  []string
+	}{
+		{group: config.Default.Group, want: []string{"127.0.0.1:9301"}},
+		{group: "bj", want: []string{"127.0.0.1:9302"}},
+		{group: "sh", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			endpoints, err := r.List("svc", tt.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(endpoints))
+			for _, endpoint := range endpoints {
+				got = append(got, endpoint.Addr)
+				if m, _ := config.ParseMetaDataInner(endpoint.Metadata); m.Weight != 50 {
+					t.Fatalf("endpoint metadata = %s, want weight 50", endpoint.Metadata)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("List(%s) = %v, want %v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConsulCheckTLS 开启 TLS 的服务使用 TLS 做 health check，地址中的 tlsSkipVerify 控制是否验证证书
+func TestConsulCheckTLS(t *testing.T) {
+	config.Default.LocalIP = "127.0.0.1"
+	f := newFakeConsul()
+	defer f.Close()
+	meta := config.DefaultMetaDataInner
+	meta.TLS = config.MetaTLS
+
+	tests := []struct {
+		addr    string
+		want    bool
+		wantErr bool
+	}{
+		{addr: f.addr(), want: false},
+		{addr: f.addr() + "?tlsSkipVerify=true", want: true},
+		{addr: f.addr() + "?tlsSkipVerify=false", want: false},
+		{addr: f.addr() + "?tlsSkipVerify=yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			r, err := newConsulRegistry(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newConsulRegistry(%s) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			if err := r.RegisterService("svc", 9301, meta); err != nil {
+				t.Fatal(err)
+			}
+			f.mu.Lock()
+			check := f.services["svc-127.0.0.1:9301"].Check
+			f.mu.Unlock()
+			if check.GRPC != "127.0.0.1:9301/svc" || !check.GRPCUseTLS || check.TLSSkipVerify != tt.want {
+				t.Fatalf("check = %+v, want TLSSkipVerify %v", check, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsulDeregister(t *testing.T) {
+	f, r := newTestConsulRegistry(t)
+	defer f.Close()
+	defer r.Close()
+
+	r.RegisterService("svc", 9301, config.DefaultMetaDataInner, "bj")
+	if err := r.UnRegisterService("svc", 9301, "bj"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.services) != 0 {
+		t.Fatalf("services = %v after deregister", f.services)
+	}
+	if err := r.UnRegisterService("svc", 9301, "bj"); err == nil {
+		t.Fatal("deregister unknown service should fail")
+	}
+
+	if err := r.RegisterClient("svc", 100, "bj"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.kv) != 1 {
+		t.Fatalf("kv = %v after RegisterClient", f.kv)
+	}
+	if err := r.UnRegisterClient("svc", "bj"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.kv) != 0 {
+		t.Fatalf("kv = %v after UnRegisterClient", f.kv)
+	}
+}
+
+// TestConsulWatchIndexReset consul 的 index 回退之后重新开始 blocking query，继续收到实例的变化
+func TestConsulWatchIndexReset(t *testing.T) {
+	f, r := newTestConsulRegistry(t)
+	defer f.Close()
+	defer r.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	r.RegisterService("svc", 9301, config.DefaultMetaDataInner)
+	events, err := r.Watch("svc", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// index 回退之后可能收到相同的实例列表，等待直到收到 want 个实例
+	recv := func(want int) {
+		t.Helper()
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case endpoints := <-events:
+				if len(endpoints) == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Watch() timeout, want %d endpoints", want)
+			}
+		}
+	}
+	recv(1)
+
+	r.RegisterService("svc", 9302, config.DefaultMetaDataInner)
+	recv(2)
+
+	f.mu.Lock()
+	f.setIndex(1)
+	f.indexes = nil
+	f.mu.Unlock()
+	recv(2)
+
+	r.RegisterService("svc", 9303, config.DefaultMetaDataInner)
+	recv(3)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, index := range f.indexes {
+		if index == 0 {
+			return
+		}
+	}
+	t.Fatalf("blocking query indexes after reset = %v, want to restart from 0", f.indexes)
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"github.com/sirupsen/logrus"
+	"openWebSF/config"
+	"time"
+)
+
+// 多个分组中某个分组 watch 失败之后重试的间隔
+const groupRetryInterval = 3 * time.Second
+
+// ListGroups 按照 groups 的优先级返回服务的实例：优先使用排在前面的分组，该分组没有可用的实例时使用下一个分组
+// 所有的分组中都不存在该服务时返回 ErrNotFound
+func ListGroups(d Discovery, serviceName string, groups []string) ([]*Endpoint, error) {
+	if len(groups) <= 1 {
+		return d.List(serviceName, groups...)
+	}
+	all, err := listGroups(d, serviceName, groups)
+	if err != nil {
+		return nil, err
+	}
+	return selectGroup(all), nil
+}
+
+// WatchGroups 与 ListGroups 相同的优先级规则 watch 多个分组，任意一个分组变化时重新选择分组
+// 返回的 channel 只在 stopCh 关闭之后关闭，某个分组 watch 失败时不断重试
+func WatchGroups(d Discovery, serviceName string, stopCh <-chan struct{}, groups []string) (<-chan []*Endpoint, error) {
+	if len(groups) <= 1 {
+		return d.Watch(serviceName, stopCh, groups...)
+	}
+	all, err := listGroups(d, serviceName, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	type groupUpdate struct {
+		index     int
+		endpoints []*Endpoint
+	}
+	updates := make(chan groupUpdate)
+	for i, group := range groups {
+		go func(i int, group string) {
+			for {
+				events, err := d.Watch(serviceName, stopCh, group)
+				if err == ErrNotFound {
+					select {
+					case updates <- groupUpdate{i, nil}:
+					case <-stopCh:
+						return
+					}
+				} else if err != nil {
+					logrus.Warnf("watch service[%s] of group[%s] failed, error: %v", serviceName, group, err)
+				} else {
+					for endpoints := range events {
+						select {
+						case updates <- groupUpdate{i, endpoints}:
+						case <-stopCh:
+							return
+						}
+					}
+					// watch 异常结束时保留该分组之前的实例，重新 watch 之后再更新
+					logrus.Warnf("watch service[%s] of group[%s] stopped, retry", serviceName, group)
+				}
+				select {
+				case <-time.After(groupRetryInterval):
+				case <-stopCh:
+					return
+				}
+			}
+		}(i, group)
+	}
+
+	ch := make(chan []*Endpoint)
+	go func() {
+		defer close(ch)
+		endpoints := selectGroup(all)
+		for {
+			select {
+			case ch <- endpoints:
+			case <-stopCh:
+				return
+			}
+			for {
+				var update groupUpdate
+				select {
+				case update = <-updates:
+				case <-stopCh:
+					return
+				}
+				all[update.index] = update.endpoints
+				if current := selectGroup(all); !equalEndpoints(current, endpoints) {
+					endpoints = current
+					break
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// listGroups 返回每个分组的实例，不存在该服务的分组为 nil
+func listGroups(d Discovery, serviceName string, groups []string) ([][]*Endpoint, error) {
+	all := make([][]*Endpoint, len(groups))
+	found := false
+	for i, group := range groups {
+		endpoints, err := d.List(serviceName, group)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		all[i] = endpoints
+		found = true
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return all, nil
+}
+
+// selectGroup 返回第一个有在线实例的分组，所有的分组都没有在线实例时返回第一个有实例的分组
+func selectGroup(all [][]*Endpoint) []*Endpoint {
+	for _, endpoints := range all {
+		for _, endpoint := range endpoints {
+			if meta, _ := config.ParseMetaDataInner(endpoint.Metadata); meta.Online() {
+				return endpoints
+			}
+		}
+	}
+	for _, endpoints := range all {
+		if len(endpoints) > 0 {
+			return endpoints
+		}
+	}
+	return []*Endpoint{}
+}
@@ -0,0 +1,263 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"openWebSF/config"
+	"openWebSF/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	fileScheme = "file"
+
+	// 检查文件是否修改的间隔
+	fileReloadInterval = time.Second
+)
+
+func init() {
+	AddBackend(fileScheme, newFileRegistry)
+}
+
+// fileServices 文件的格式如下：
+//
+//	services:
+//	  - name: wosf.hello.v1.helloService
+//	    group: default # 可选，默认为 NODE_CLUSTER 环境变量的值
+//	    endpoints:
+//	      127.0.0.1:9301: weight=100&active=0
+//	      127.0.0.1:9302: weight=50
+//	      "[::1]:9303": weight=50 # IPv6 的地址必须使用方括号并且加引号，否则 YAML 解析为数组
+//
+// 同一个分组中的服务只能出现一次，名称和分组重复时加载失败
+type fileServices struct {
+	Services []struct {
+		Name      string            `yaml:"name"`
+		Group     string            `yaml:"group"`
+		Endpoints map[string]string `yaml:"endpoints"`
+	} `yaml:"services"`
+}
+
+// fileRegistry 静态的注册中心，服务信息从本地文件中读取，文件修改之后自动重新加载
+// 不支持注册，Register/UnRegister 相关的函数不做任何操作
+type fileRegistry struct {
+	sync.RWMutex
+	path     string
+	modTime  time.Time
+	size     int64
+	services map[string][]*Endpoint // key 为 utils.ServicePrefix
+	watchers map[chan struct{}]struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newFileRegistry addr 格式为 file://path/to/services.yaml 或者 file:///path/to/services.yaml
+func newFileRegistry(addr string) (Registry, error) {
+	_, path := utils.ParseRegistryAddr(addr)
+	r := &fileRegistry{
+		path:     path,
+		watchers: make(map[chan struct{}]struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.poll()
+	return r, nil
+}
+
+func (r *fileRegistry) RegisterService(serviceName string, port int, metadata config.MetaDataInner, groups ...string) error {
+	logrus.Debugf("file registry %s is static, ignore register service[%s]", r.path, serviceName)
+	return nil
+}
+
+func (r *fileRegistry) UnRegisterService(serviceName string, port int, groups ...string) error {
+	return nil
+}
+
+func (r *fileRegistry) RegisterClient(serviceName string, pid int, groups ...string) error {
+	return nil
+}
+
+func (r *fileRegistry) UnRegisterClient(serviceName string, groups ...string) error {
+	return nil
+}
+
+func (r *fileRegistry) List(serviceName string, groups ...string) ([]*Endpoint, error) {
+	r.RLock()
+	defer r.RUnlock()
+	endpoints, ok := r.services[utils.ServicePrefix(serviceName, groups...)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return endpoints, nil
+}
+
+func (r *fileRegistry) Watch(serviceName string, stopCh <-chan struct{}, groups ...string) (<-chan []*Endpoint, error) {
+	endpoints, err := r.List(serviceName, groups...)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	r.Lock()
+	r.watchers[events] = struct{}{}
+	r.Unlock()
+
+	ch := make(chan []*Endpoint)
+	go func() {
+		defer close(ch)
+		defer func() {
+			r.Lock()
+			delete(r.watchers, events)
+			r.Unlock()
+		}()
+
+		for {
+			select {
+			case ch <- endpoints:
+			case <-stopCh:
+				return
+			case <-r.done:
+				return
+			}
+			for {
+				select {
+				case <-events:
+				case <-stopCh:
+					return
+				case <-r.done:
+					return
+				}
+				current, err := r.List(serviceName, groups...)
+				if err == ErrNotFound {
+					// 服务从文件中删除之后通知所有的实例都已下线
+					current = []*Endpoint{}
+				}
+				if !equalEndpoints(current, endpoints) {
+					endpoints = current
+					break
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *fileRegistry) Close() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+// poll 定时检查文件是否被修改
+func (r *fileRegistry) poll() {
+	ticker := time.NewTicker(fileReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if changed, err := r.reload(); err != nil {
+				logrus.Errorf("reload registry file %s failed, error: %v", r.path, err)
+			} else if changed {
+				logrus.Infof("registry file %s reloaded", r.path)
+				r.notify()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// reload 文件修改之后重新加载，解析失败时保留之前的内容
+func (r *fileRegistry) reload() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+	r.RLock()
+	unchanged := info.ModTime().Equal(r.modTime) && info.Size() == r.size
+	r.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return false, err
+	}
+	var conf fileServices
+	if err := yaml.Unmarshal(content, &conf); err != nil {
+		return false, err
+	}
+
+	services := make(map[string][]*Endpoint)
+	for _, service := range conf.Services {
+		var key string
+		if service.Group != "" {
+			key = utils.ServicePrefix(service.Name, service.Group)
+		} else {
+			key = utils.ServicePrefix(service.Name)
+		}
+		if _, ok := services[key]; ok {
+			group := service.Group
+			if group == "" {
+				group = config.Default.Group
+			}
+			return false, fmt.Errorf("service[%s] group[%s] duplicated", service.Name, group)
+		}
+		endpoints := make([]*Endpoint, 0, len(service.Endpoints))
+		for endpoint, metadata := range service.Endpoints {
+			addr, err := utils.NormalizeHostPort(endpoint)
+			if err != nil {
+				return false, fmt.Errorf("service[%s] endpoint[%s] invalid, error: %v", service.Name, endpoint, err)
+			}
+			if metadata == "" {
+				metadata = config.DefaultMetaDataInner.String()
+			}
+			endpoints = append(endpoints, &Endpoint{
+				Addr:     addr,
+				Metadata: metadata,
+			})
+		}
+		sort.Slice(endpoints, func(i, j int) bool {
+			return endpoints[i].Addr < endpoints[j].Addr
+		})
+		services[key] = endpoints
+	}
+
+	r.Lock()
+	r.services = services
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	r.Unlock()
+	return true, nil
+}
+
+func (r *fileRegistry) notify() {
+	r.RLock()
+	defer r.RUnlock()
+	for ch := range r.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func equalEndpoints(a, b []*Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeServices(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "file_registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "services.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileRegistryLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		group   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "ipv4",
+			content: `services:
+  - name: svc
+    endpoints:
+      127.0.0.1:9302: weight=50
+      127.0.0.1:9301:
+`,
+			want: []string{"127.0.0.1:9301", "127.0.0.1:9302"},
+		},
+		{
+			name: "quoted ipv6",
+			content: `services:
+  - name: svc
+    endpoints:
+      "[::1]:9301": weight=50
+`,
+			want: []string{"[::1]:9301"},
+		},
+		{
+			name: "unquoted ipv6",
+			content: `services:
+  - name: svc
+    endpoints:
+      [::1]:9301: weight=50
+`,
+			wantErr: true,
+		},
+		{
+			name: "groups",
+			content: `services:
+  - name: svc
+    endpoints:
+      127.0.0.1:9301:
+  - name: svc
+    group: bj
+    endpoints:
+      127.0.0.1:9302:
+`,
+			group: "bj",
+			want:  []string{"127.0.0.1:9302"},
+		},
+		{
+			name: "duplicated name and group",
+			content: `services:
+  - name: svc
+    endpoints:
+      127.0.0.1:9301:
+  - name: svc
+    endpoints:
+      127.0.0.1:9302:
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeServices(t, tt.content)
+			defer os.RemoveAll(filepath.Dir(path))
+			r, err := newFileRegistry(fileScheme + "://" + path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFileRegistry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			var groups []string
+			if tt.group != "" {
+				groups = append(groups, tt.group)
+			}
+			endpoints, err := r.List("svc", groups...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(endpoints))
+			for _, endpoint := range endpoints {
+				got = append(got, endpoint.Addr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
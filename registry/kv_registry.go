@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/docker/libkv/store"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"openWebSF/config"
+	"openWebSF/utils"
+	"openWebSF/utils/zk"
+	"path"
+	"sync"
+	"time"
+)
+
+// kvRegistry 基于 libkv store 的注册中心实现
+type kvRegistry struct {
+	sync.Mutex
+	store store.Store
+}
+
+func newKVRegistry(addr string) (Registry, error) {
+	kvStore, err := zk.GetStore(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &kvRegistry{
+		store: kvStore,
+	}, nil
+}
+
+func (r *kvRegistry) RegisterService(serviceName string, port int, metadata config.MetaDataInner, groups ...string) error {
+	key := utils.ServiceKey(serviceName, port, groups...)
+	value := []byte(metadata.String())
+	return r.register(key, value)
+}
+
+func (r *kvRegistry) UnRegisterService(serviceName string, port int, groups ...string) error {
+	key := utils.ServiceKey(serviceName, port, groups...)
+	return r.unregister(key)
+}
+
+func (r *kvRegistry) RegisterClient(serviceName string, pid int, groups ...string) error {
+	key := utils.ClientKey(serviceName, groups...)
+	value := []byte(fmt.Sprintf("%d", pid))
+	return r.register(key, value)
+
+}
+
+func (r *kvRegistry) UnRegisterClient(serviceName string, groups ...string) error {
+	key := utils.ClientKey(serviceName, groups...)
+	return r.unregister(key)
+}
+
+func (r *kvRegistry) List(serviceName string, groups ...string) ([]*Endpoint, error) {
+	pairs, err := r.store.List(utils.ServicePrefix(serviceName, groups...))
+	if err == store.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return toEndpoints(pairs), nil
+}
+
+func (r *kvRegistry) Watch(serviceName string, stopCh <-chan struct{}, groups ...string) (<-chan []*Endpoint, error) {
+	events, err := r.store.WatchTree(utils.ServicePrefix(serviceName, groups...), stopCh)
+	if err == store.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	ch := make(chan []*Endpoint)
+	go func() {
+		defer close(ch)
+		for pairs := range events {
+			select {
+			case ch <- toEndpoints(pairs):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *kvRegistry) register(key string, value []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.store.Delete(key); err != nil && err != store.ErrKeyNotFound {
+		return err
+	} else if err == nil {
+		logrus.Debugf("key[%s] already registered, delete first", key)
+	}
+	if err := r.store.Put(key, value, &store.WriteOptions{TTL: time.Second}); err != nil {
+		return err
+	}
+	logrus.Infof("register [%s] to registration center success", key)
+	return nil
+}
+
+func (r *kvRegistry) unregister(key string) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.store.Delete(key); err != nil {
+		if err == store.ErrKeyNotFound {
+			logrus.Warnf("unregister key[%s] failed, not found the key, this should not happen", key)
+		}
+		return err
+	}
+	logrus.Infof("unregister key[%s] succeed from to registry center", key)
+	return nil
+}
+
+func (r *kvRegistry) Close() {
+	r.store.Close()
+}
+
+func toEndpoints(pairs []*store.KVPair) []*Endpoint {
+	endpoints := make([]*Endpoint, 0, len(pairs))
+	for _, pair := range pairs {
+		// zookeeper 的 List 只返回子节点名称，其它 store 可能返回完整的 key
+		addr, err := url.QueryUnescape(path.Base(pair.Key))
+		if err != nil {
+			logrus.Errorf("url.QueryUnescape(%s) failed, error: %v", pair.Key, err)
+			continue
+		}
+		if addr, err = utils.NormalizeHostPort(addr); err != nil {
+			logrus.Errorf("registry key[%s] invalid, error: %v", pair.Key, err)
+			continue
+		}
+		endpoints = append(endpoints, &Endpoint{
+			Addr:     addr,
+			Metadata: string(pair.Value),
+		})
+	}
+	return endpoints
+}
@@ -1,84 +1,92 @@
 package registry
 
 import (
+	"errors"
 	"fmt"
-	"github.com/docker/libkv/store"
 	"github.com/sirupsen/logrus"
 	"openWebSF/config"
 	"openWebSF/utils"
-	"openWebSF/utils/zk"
 	"strings"
 	"sync"
-	"time"
 )
 
-type Registry struct {
-	sync.Mutex
-	store store.Store
+// ErrNotFound 注册中心中不存在该服务
+var ErrNotFound = errors.New("service not found in registry")
+
+// Endpoint 注册中心中的一个服务实例
+type Endpoint struct {
+	Addr     string // ip:port
+	Metadata string // config.MetaDataInner.String() 的值
 }
 
-func Register(servers string) *Registry {
-	logrus.Debugln("new store for registration center, address:", servers)
-	target := ParseTarget(servers)
-	kvStore, err := zk.GetStore(target)
-	if err != nil {
-		logrus.Errorf("initial store to registration center %s failed, error: %v", servers, err)
-		return nil
-	}
-	return &Registry{
-		store: kvStore,
-	}
+// Registrar 负责将服务端/客户端信息注册到注册中心，groups 为空时使用 config.Default.Group
+type Registrar interface {
+	RegisterService(serviceName string, port int, metadata config.MetaDataInner, groups ...string) error
+	UnRegisterService(serviceName string, port int, groups ...string) error
+	RegisterClient(serviceName string, pid int, groups ...string) error
+	UnRegisterClient(serviceName string, groups ...string) error
 }
 
-func (r *Registry) RegisterService(serviceName string, port int, metadata config.MetaDataInner) error {
-	key := utils.ServiceKey(serviceName, port)
-	value := []byte(metadata.String())
-	return r.register(key, value)
+// Discovery 负责从注册中心发现服务实例
+type Discovery interface {
+	// List 返回服务当前所有的实例
+	List(serviceName string, groups ...string) ([]*Endpoint, error)
+	// Watch 返回的 channel 中每次都是服务最新的全部实例，stopCh 关闭后停止 watch
+	Watch(serviceName string, stopCh <-chan struct{}, groups ...string) (<-chan []*Endpoint, error)
 }
 
-func (r *Registry) UnRegisterService(serviceName string, port int) error {
-	key := utils.ServiceKey(serviceName, port)
-	return r.unregister(key)
+// Registry 注册中心的一种实现，例如 zookeeper
+type Registry interface {
+	Registrar
+	Discovery
+	Close()
 }
 
-func (r *Registry) RegisterClient(serviceName string, pid int) error {
-	key := utils.ClientKey(serviceName)
-	value := []byte(fmt.Sprintf("%d", pid))
-	return r.register(key, value)
+// Initialize 根据注册中心地址创建 Registry，addr 中包含 scheme
+type Initialize func(addr string) (Registry, error)
 
+var backends = struct {
+	sync.RWMutex
+	m map[string]Initialize
+}{
+	m: make(map[string]Initialize),
 }
 
-func (r *Registry) UnRegisterClient(serviceName string) error {
-	key := utils.ClientKey(serviceName)
-	return r.unregister(key)
+// AddBackend 注册 scheme 对应的注册中心实现
+// 未通过 AddBackend 注册的 scheme 使用基于 libkv store 的实现，具体的 store 由 zk.GetStore 根据 scheme 选择
+func AddBackend(scheme string, init Initialize) {
+	backends.Lock()
+	defer backends.Unlock()
+	backends.m[scheme] = init
 }
 
-func (r *Registry) register(key string, value []byte) error {
-	r.Lock()
-	defer r.Unlock()
-	if err := r.store.Delete(key); err != nil && err != store.ErrKeyNotFound {
-		return err
-	} else if err == nil {
-		logrus.Debugf("key[%s] already registered, delete first", key)
-	}
-	if err := r.store.Put(key, value, &store.WriteOptions{TTL: time.Second}); err != nil {
-		return err
+// Register 根据注册中心地址的 scheme 选择注册中心实现，例如：
+// zookeeper:///127.0.0.1:2181 或者 127.0.0.1:2181 使用 zookeeper
+// 失败时记录日志并返回 nil，需要错误信息时使用 New
+func Register(addr string) Registry {
+	r, err := New(addr)
+	if err != nil {
+		logrus.Errorln(err)
+		return nil
 	}
-	logrus.Infof("register [%s] to registration center success", key)
-	return nil
+	return r
 }
 
-func (r *Registry) unregister(key string) error {
-	r.Lock()
-	defer r.Unlock()
-	if err := r.store.Delete(key); err != nil {
-		if err == store.ErrKeyNotFound {
-			logrus.Warnf("unregister key[%s] failed, not found the key, this should not happen", key)
-		}
-		return err
+// New 与 Register 相同，失败时返回错误
+func New(addr string) (Registry, error) {
+	logrus.Debugln("new store for registration center, address:", addr)
+	scheme, _ := utils.ParseRegistryAddr(addr)
+	backends.RLock()
+	init, ok := backends.m[scheme]
+	backends.RUnlock()
+	if !ok {
+		init = newKVRegistry
+	}
+	r, err := init(addr)
+	if err != nil {
+		return nil, fmt.Errorf("initial store to registration center %s failed, error: %v", addr, err)
 	}
-	logrus.Infof("unregister key[%s] succeed from to registry center", key)
-	return nil
+	return r, nil
 }
 
 func split2(s, sep string) (string, string, bool) {
@@ -101,7 +109,3 @@ func ParseTarget(target string) string {
 	}
 	return endpoint
 }
-
-func (r *Registry) Close() {
-	r.store.Close()
-}
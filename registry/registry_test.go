@@ -0,0 +1,88 @@
+package registry_test
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"openWebSF/client"
+	"openWebSF/config"
+	"openWebSF/config/serverConf"
+	"openWebSF/example/pb"
+	"openWebSF/registry"
+	"openWebSF/server"
+	"testing"
+	"time"
+)
+
+type helloServer struct{}
+
+func (helloServer) HelloWorld(ctx context.Context, req *pb.HelloRequest) (*pb.HelloRespone, error) {
+	return &pb.HelloRespone{Name: req.Name}, nil
+}
+
+// TestRegisterAndResolve server 注册到 memory 注册中心之后，client 通过服务名发现实例，balancer 选择该实例
+func TestRegisterAndResolve(t *testing.T) {
+	const addr = "memory://e2e"
+	const service = "wosf.hello.v1.helloService"
+	config.Default.LocalIP = "127.0.0.1"
+	conf := serverConf.Conf
+	defer func() { serverConf.Conf = conf }()
+	serverConf.Conf.RegisterAddr = addr
+
+	s, err := server.NewServerE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterE(server.ServiceConfig{Name: service, RegisterService: pb.RegisterHelloServiceServer, Server: helloServer{}}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(0)
+	defer s.Shutdown()
+
+	r, err := registry.New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var endpoints []*registry.Endpoint
+	for deadline := time.Now().Add(5 * time.Second); len(endpoints) == 0; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("service not registered")
+		}
+		endpoints, _ = r.List(service, config.Default.Group)
+	}
+
+	tests := []struct {
+		name     string
+		balancer client.Balancer
+	}{
+		{name: "weighted round robin", balancer: client.WRoundRobin},
+		{name: "random", balancer: client.Random},
+		{name: "experimental weighted round robin", balancer: client.WRoundRobinExperimental},
+		{name: "experimental random", balancer: client.RandomExperimental},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := client.NewClientE(client.ClientConfig{
+				Service:      service,
+				Registry:     addr,
+				Balancer:     tt.balancer,
+				Experimental: tt.balancer >= client.WRoundRobinExperimental,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var p peer.Peer
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			resp, err := pb.NewHelloServiceClient(conn).HelloWorld(ctx, &pb.HelloRequest{Name: "e2e"}, grpc.FailFast(false), grpc.Peer(&p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Name != "e2e" || p.Addr.String() != endpoints[0].Addr {
+				t.Fatalf("HelloWorld() = %v from %v, want e2e from %s", resp.Name, p.Addr, endpoints[0].Addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/resolver"
+	"net/url"
+	"openWebSF/config"
+	"openWebSF/utils"
+	"openWebSF/utils/tlsutil"
+	"sort"
+	"strings"
+)
+
+const directScheme = "direct"
+
+func init() {
+	// 所有直连的 client 共用一个 builder，地址和 metadata 保存在 target 中
+	resolver.Register(&directBuilder{})
+}
+
+// directAddrs 将 ClientConfig.DirectAddr 转换为地址列表，map 的值作为 metadata，为空时使用默认值
+func directAddrs(addrs map[string]string) ([]string, map[string]string) {
+	keys := make([]string, 0, len(addrs))
+	metadata := make(map[string]string, len(addrs))
+	for addr, meta := range addrs {
+		if normalized, err := utils.NormalizeHostPort(addr); err == nil {
+			addr = normalized
+		} else {
+			logrus.Warnf("direct address %s invalid, error: %v", addr, err)
+		}
+		if meta == "" {
+			meta = config.DefaultMetaDataInner.String()
+		}
+		keys = append(keys, addr)
+		metadata[addr] = meta
+	}
+	sort.Strings(keys)
+	return keys, metadata
+}
+
+// DirectTarget 返回直连方式下 grpc.Dial 使用的 target，地址和 metadata 编码在 endpoint 中，
+// 例如 direct:///127.0.0.1%3A9301=weight%3D50%26...，相同的地址和 metadata 返回相同的 target
+func DirectTarget(addrs map[string]string) string {
+	_, metadata := directAddrs(addrs)
+	values := make(url.Values, len(metadata))
+	for addr, meta := range metadata {
+		values.Set(addr, meta)
+	}
+	return fmt.Sprintf("%s:///%s", directScheme, values.Encode())
+}
+
+// parseDirectTarget 解析 DirectTarget 返回的 target 中的地址和 metadata
+func parseDirectTarget(endpoint string) ([]resolver.Address, error) {
+	values, err := url.ParseQuery(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(values))
+	for addr := range values {
+		metadata[addr] = values.Get(addr)
+	}
+	return resolverAddrs(metadata), nil
+}
+
+// resolverAddrs 返回按地址排序的 resolver.Address
+func resolverAddrs(metadata map[string]string) []resolver.Address {
+	keys := make([]string, 0, len(metadata))
+	for addr := range metadata {
+		keys = append(keys, addr)
+	}
+	sort.Strings(keys)
+	addrs := make([]resolver.Address, 0, len(keys))
+	for _, addr := range keys {
+		addrs = append(addrs, resolver.Address{
+			Addr:     addr,
+			Type:     resolver.Backend,
+			Metadata: parseMetadata(metadata[addr]),
+		})
+	}
+	return addrs
+}
+
+type directBuilder struct{}
+
+func (*directBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	addrs, err := parseDirectTarget(target.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("direct target %s invalid, error: %v", target.Endpoint, err)
+	}
+	// 直连时没有服务名，检查实例整体的 health 状态
+	cc.NewServiceConfig(healthCheckServiceConfig(""))
+	cc.NewAddress(addrs)
+	return &directResolver{}, nil
+}
+
+func (*directBuilder) Scheme() string {
+	return directScheme
+}
+
+type directResolver struct{}
+
+func (*directResolver) ResolveNow(o resolver.ResolveNowOption) {}
+
+func (*directResolver) Close() {}
+
+// InitDirect 返回直连地址对应的 grpc.Dial 使用的 target 和实例是否要求 TLS
+func InitDirect(addrs map[string]string) (string, *tlsutil.Instances) {
+	_, metadata := directAddrs(addrs)
+	instances := tlsutil.NewInstances()
+	instances.Update(requireTLS(resolverAddrs(metadata)))
+	return DirectTarget(addrs), instances
+}
+
+type direct struct {
+	addrs     map[string]string
+	instances *tlsutil.Instances
+}
+
+// DirectResolve 返回直连地址对应的 naming.Resolver，用于非 experimental 的 balancer
+func DirectResolve(addrs map[string]string) *direct {
+	return &direct{
+		addrs:     addrs,
+		instances: tlsutil.NewInstances(),
+	}
+}
+
+// Instances 返回实例是否要求 TLS，Resolve 返回的 watcher 更新
+func (r *direct) Instances() *tlsutil.Instances {
+	return r.instances
+}
+
+// Target 返回 grpc.Dial 使用的 target，地址由 balancer 通过 Resolve 获取，
+// 使用 passthrough 避免 grpc 选择 experimental 的 direct resolver
+func (r *direct) Target() string {
+	keys, _ := directAddrs(r.addrs)
+	return "passthrough:///" + strings.Join(keys, ",")
+}
+
+func (r *direct) Resolve(target string) (naming.Watcher, error) {
+	return &directWatcher{
+		addrs:     r.addrs,
+		instances: r.instances,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// directWatcher 第一次调用 Next 时返回全部地址，之后阻塞直到 Close
+type directWatcher struct {
+	addrs     map[string]string
+	instances *tlsutil.Instances
+	sent      bool
+	done      chan struct{}
+}
+
+func (w *directWatcher) Next() ([]*naming.Update, error) {
+	if !w.sent {
+		w.sent = true
+		keys, metadata := directAddrs(w.addrs)
+		updates := make([]*naming.Update, 0, len(keys))
+		tls := make(map[string]bool, len(keys))
+		for _, addr := range keys {
+			meta := parseMetadata(metadata[addr])
+			tls[addr] = meta.TLS == config.MetaTLS
+			updates = append(updates, &naming.Update{
+				Op:       naming.Add,
+				Addr:     addr,
+				Metadata: meta,
+			})
+		}
+		w.instances.Update(tls)
+		return updates, nil
+	}
+	<-w.done
+	return nil, errWatcherClosed
+}
+
+func (w *directWatcher) Close() {
+	close(w.done)
+}
@@ -0,0 +1,72 @@
+package resolver
+
+import (
+	"google.golang.org/grpc/resolver"
+	"openWebSF/config"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDirectTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs map[string]string
+		want  map[string]string
+	}{
+		{
+			name:  "metadata",
+			addrs: map[string]string{"127.0.0.1:9302": "weight=50&active=1", "127.0.0.1:9301": ""},
+			want:  map[string]string{"127.0.0.1:9301": config.DefaultMetaDataInner.String(), "127.0.0.1:9302": "weight=50&active=1"},
+		},
+		{
+			name:  "ipv6",
+			addrs: map[string]string{"[::1]:9301": "tls=1"},
+			want:  map[string]string{"[::1]:9301": "tls=1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, instances := InitDirect(tt.addrs)
+			if target != DirectTarget(tt.addrs) {
+				t.Fatalf("InitDirect() target = %s, want the same as DirectTarget() %s", target, DirectTarget(tt.addrs))
+			}
+			if !strings.HasPrefix(target, directScheme+":///") {
+				t.Fatalf("DirectTarget() = %s, want scheme %s", target, directScheme)
+			}
+			addrs, err := parseDirectTarget(strings.TrimPrefix(target, directScheme+":///"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string, len(addrs))
+			for _, addr := range addrs {
+				got[addr.Addr] = addr.Metadata.(config.MetaDataInner).String()
+			}
+			want := make(map[string]string, len(tt.want))
+			for addr, meta := range tt.want {
+				want[addr] = parseMetadata(meta).String()
+				tls, known := instances.RequireTLS(addr)
+				if !known || tls != (parseMetadata(meta).TLS == config.MetaTLS) {
+					t.Fatalf("RequireTLS(%s) = %v, %v", addr, tls, known)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("parseDirectTarget() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestDirectSingleBuilder 所有直连的 client 共用 init 中注册的 builder
+func TestDirectSingleBuilder(t *testing.T) {
+	b := resolver.Get(directScheme)
+	if b == nil {
+		t.Fatalf("resolver %s not registered", directScheme)
+	}
+	for i := 0; i < 3; i++ {
+		InitDirect(map[string]string{"127.0.0.1:9301": ""})
+	}
+	if resolver.Get(directScheme) != b || resolver.Get(directScheme+"-1") != nil {
+		t.Fatal("InitDirect() registered a new resolver builder")
+	}
+}
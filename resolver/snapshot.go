@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"openWebSF/config"
+	"openWebSF/registry"
+	"openWebSF/utils"
+	"os"
+	"path/filepath"
+)
+
+// snapshot 将从注册中心获取到的服务地址保存到本地文件中
+// 注册中心不可用时（例如 zookeeper 故障期间客户端重启）使用快照中的地址
+type snapshot struct {
+	dir         string // 为空时不使用快照
+	serviceName string
+	groups      []string
+}
+
+func newSnapshot(dir string, serviceName string, groups ...string) *snapshot {
+	if dir == "" {
+		dir = config.Default.SnapshotDir
+	}
+	return &snapshot{
+		dir:         dir,
+		serviceName: serviceName,
+		groups:      groups,
+	}
+}
+
+func (s *snapshot) path() string {
+	return filepath.Join(s.dir, filepath.FromSlash(utils.ServicePrefix(s.serviceName, s.groups...))+".json")
+}
+
+// save 保存服务地址，地址列表为空时不覆盖之前的快照，避免注册中心异常时丢失所有地址
+func (s *snapshot) save(endpoints []*registry.Endpoint) {
+	if s.dir == "" || len(endpoints) == 0 {
+		return
+	}
+	content, err := json.Marshal(endpoints)
+	if err != nil {
+		logrus.Warnf("marshal snapshot of service[%s] failed, error: %v", s.serviceName, err)
+		return
+	}
+
+	path := s.path()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logrus.Warnf("create snapshot dir of service[%s] failed, error: %v", s.serviceName, err)
+		return
+	}
+	// 先写临时文件再 rename，避免进程退出时留下不完整的快照
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		logrus.Warnf("write snapshot of service[%s] failed, error: %v", s.serviceName, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logrus.Warnf("rename snapshot of service[%s] failed, error: %v", s.serviceName, err)
+	}
+}
+
+func (s *snapshot) load() ([]*registry.Endpoint, error) {
+	if s.dir == "" {
+		return nil, os.ErrNotExist
+	}
+	content, err := ioutil.ReadFile(s.path())
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*registry.Endpoint
+	if err := json.Unmarshal(content, &endpoints); err != nil {
+		return nil, err
+	}
+	logrus.Warnf("registry unavailable, use snapshot of service[%s]: %d endpoints", s.serviceName, len(endpoints))
+	return endpoints, nil
+}
@@ -1,104 +1,160 @@
 package resolver
 
 import (
-	"github.com/docker/libkv/store"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/naming"
 	"openWebSF/config"
-	"openWebSF/utils"
-	"openWebSF/utils/zk"
+	"openWebSF/registry"
 	"time"
 )
 
+var errWatcherClosed = errors.New("registry watcher closed")
+
+const (
+	// 访问注册中心失败之后重试的间隔
+	retryInterval = 3 * time.Second
+	// 连续失败时重试间隔翻倍，最长为 maxRetryInterval
+	maxRetryInterval = 30 * time.Second
+)
+
 type watcher struct {
-	zkClient   *zk.Client
+	addr       string // 注册中心地址
+	registry   registry.Registry
 	zkResolver *zookeeper
+	snapshot   *snapshot
 	servers    map[string]string
-	event      <-chan []*store.KVPair
+	event      <-chan []*registry.Endpoint
+	stopCh     chan struct{}
 }
 
-func NewWatcher(zkClient *zk.Client, zkResolver *zookeeper) (*watcher) {
+func NewWatcher(addr string, zkResolver *zookeeper) *watcher {
 	return &watcher{
-		zkClient:   zkClient,
+		addr:       addr,
 		zkResolver: zkResolver,
+		snapshot:   newSnapshot(zkResolver.snapshotDir, zkResolver.name, zkResolver.groups...),
 		servers:    make(map[string]string),
+		stopCh:     make(chan struct{}),
 	}
 }
 
 func (w *watcher) Next() ([]*naming.Update, error) {
-	if w.event == nil {
-		prefix := utils.ServicePrefix(w.zkResolver.name)
-		pairs, err := w.zkClient.List(prefix)
-		if err == store.ErrKeyNotFound {
-			logrus.Errorf("watcher list %s failed, error: %v\n", prefix, err)
-			time.Sleep(3 * time.Second)
-			return nil, nil
-		} else if nil != err {
-			logrus.Errorf("watcher list %s failed, error: %v\n", prefix, err)
-		}
-		updates := make([]*naming.Update, len(pairs))
-		for i, pair := range pairs {
-			addr, mete, err := getServerInfo(pair)
+	name := w.zkResolver.name
+	for {
+		if w.event == nil {
+			endpoints, err := w.list()
 			if err != nil {
+				if err == registry.ErrNotFound {
+					// 注册中心中不存在该服务时删除所有的地址，不使用快照中的地址，等待服务注册
+					logrus.Warnf("watcher list %s failed, error: %v", name, err)
+					if updates := w.diff(nil); len(updates) > 0 {
+						return updates, nil
+					}
+				} else {
+					logrus.Errorf("watcher list %s failed, error: %v\n", name, err)
+					// 注册中心不可用并且还没有地址时使用快照中的地址，注册中心恢复之后再更新
+					if len(w.servers) == 0 {
+						if endpoints, err := w.snapshot.load(); err == nil && len(endpoints) > 0 {
+							return w.diff(endpoints), nil
+						}
+					}
+				}
+				select {
+				case <-time.After(retryInterval):
+				case <-w.stopCh:
+					return nil, errWatcherClosed
+				}
 				continue
 			}
-			updates[i] = &naming.Update{
-				Op:       naming.Add,
-				Addr:     addr,
-				Metadata: mete,
+			w.snapshot.save(endpoints)
+			return w.diff(endpoints), nil
+		}
+
+		select {
+		case endpoints, ok := <-w.event:
+			if !ok {
+				// watch 异常结束（例如与注册中心的连接断开），重新 list 并 watch
+				logrus.Warnf("watcher watch service %s stopped, retry", name)
+				w.event = nil
+				continue
 			}
-			w.servers[addr] = mete
+			w.snapshot.save(endpoints)
+			return w.diff(endpoints), nil
+		case <-w.stopCh:
+			return nil, errWatcherClosed
 		}
-		stopCh := make(chan struct{})
-		w.event, err = w.zkClient.WatchTree(prefix, stopCh)
-		if err != nil {
-			logrus.Errorf("watcher watchtree key %s failed, error: %v\n", prefix, err)
-			return nil, err
+	}
+}
+
+// list 返回服务当前所有的实例，并开始 watch
+func (w *watcher) list() ([]*registry.Endpoint, error) {
+	if w.registry == nil {
+		reg := registry.Register(w.addr)
+		if reg == nil {
+			return nil, errRegistryUnavailable
 		}
-		return updates, nil
+		w.registry = reg
+	}
+	name := w.zkResolver.name
+	endpoints, err := registry.ListGroups(w.registry, name, w.zkResolver.groups)
+	if err != nil {
+		return nil, err
+	}
+	w.event, err = registry.WatchGroups(w.registry, name, w.stopCh, w.zkResolver.groups)
+	if err != nil {
+		return nil, err
 	}
+	return endpoints, nil
+}
 
-	return w.getUpdate(w.event), nil
+func (w *watcher) Close() {
+	close(w.stopCh)
+	if w.registry != nil {
+		w.registry.Close()
+	}
 }
 
-func (w *watcher) Close() {}
+// diff 比较最新的实例和当前的实例，只返回有变化的实例的 Add/Modify/Delete 的更新
+func (w *watcher) diff(endpoints []*registry.Endpoint) []*naming.Update {
+	updates := make([]*naming.Update, 0)
+	currentServers := make(map[string]string)
+	for _, endpoint := range endpoints {
+		addr, mete := endpoint.Addr, endpoint.Metadata
+		currentServers[addr] = mete
+		v, ok := w.servers[addr]
+		if ok && v == mete {
+			// 没有变化的实例不发送更新，naming.Operation 的零值为 Add
+			continue
+		}
+		update := &naming.Update{
+			Op:       naming.Add,
+			Addr:     addr,
+			Metadata: parseMetadata(mete),
+		}
+		if ok {
+			update.Op = config.Modify
+		}
+		updates = append(updates, update)
+		w.servers[addr] = mete
+	}
 
-func (w *watcher) getUpdate(event <-chan []*store.KVPair) []*naming.Update {
-	select {
-	case pairs := <-event:
-		updates := make([]*naming.Update, 0)
-		currentServers := make(map[string]string)
-		for _, pair := range pairs {
-			addr, mete, err := getServerInfo(pair)
-			if err != nil {
-				continue
-			}
-			currentServers[addr] = mete
-			v, ok := w.servers[addr]
+	for addr := range w.servers {
+		if _, ok := currentServers[addr]; !ok {
 			update := &naming.Update{
+				Op:       naming.Delete,
 				Addr:     addr,
-				Metadata: mete,
-			}
-			if ok && v != mete {
-				update.Op = config.Modify
-			} else if !ok {
-				update.Op = naming.Add
+				Metadata: parseMetadata(w.servers[addr]),
 			}
 			updates = append(updates, update)
-			w.servers[addr] = mete
+			delete(w.servers, addr)
 		}
+	}
 
-		for addr := range w.servers {
-			if _, ok := currentServers[addr]; !ok {
-				update := &naming.Update{
-					Op:       naming.Delete,
-					Addr:     addr,
-					Metadata: w.servers[addr],
-				}
-				updates = append(updates, update)
-				delete(w.servers, addr)
-			}
-		}
-		return updates
+	tls := make(map[string]bool, len(w.servers))
+	for addr, mete := range w.servers {
+		meta, _ := config.ParseMetaDataInner(mete)
+		tls[addr] = meta.TLS == config.MetaTLS
 	}
+	w.zkResolver.instances.Update(tls)
+	return updates
 }
@@ -0,0 +1,148 @@
+package resolver
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/naming"
+	"openWebSF/balancer/random"
+	"openWebSF/balancer/roundrobin"
+	"openWebSF/config"
+	"openWebSF/registry"
+	"testing"
+	"time"
+)
+
+// updatesWatcher 依次返回 updates 中的更新
+type updatesWatcher struct {
+	updates chan []*naming.Update
+	done    chan struct{}
+}
+
+func (w *updatesWatcher) Next() ([]*naming.Update, error) {
+	select {
+	case updates := <-w.updates:
+		return updates, nil
+	case <-w.done:
+		return nil, errWatcherClosed
+	}
+}
+
+func (w *updatesWatcher) Close() {}
+
+type updatesResolver struct {
+	w *updatesWatcher
+}
+
+func (r updatesResolver) Resolve(target string) (naming.Watcher, error) {
+	return r.w, nil
+}
+
+func endpoints(metadata ...string) []*registry.Endpoint {
+	addrs := []string{"127.0.0.1:9301", "127.0.0.1:9302", "127.0.0.1:9303"}
+	endpoints := make([]*registry.Endpoint, 0, len(metadata))
+	for i, meta := range metadata {
+		endpoints = append(endpoints, &registry.Endpoint{Addr: addrs[i], Metadata: meta})
+	}
+	return endpoints
+}
+
+func TestDiff(t *testing.T) {
+	steps := []struct {
+		name      string
+		endpoints []*registry.Endpoint
+		want      map[string]naming.Operation
+	}{
+		{
+			name:      "add",
+			endpoints: endpoints("weight=100", "weight=100"),
+			want:      map[string]naming.Operation{"127.0.0.1:9301": naming.Add, "127.0.0.1:9302": naming.Add},
+		},
+		{
+			name:      "modify",
+			endpoints: endpoints("weight=50", "weight=100"),
+			want:      map[string]naming.Operation{"127.0.0.1:9301": config.Modify},
+		},
+		{
+			name:      "unrelated add",
+			endpoints: endpoints("weight=50", "weight=100", "weight=100"),
+			want:      map[string]naming.Operation{"127.0.0.1:9303": naming.Add},
+		},
+		{
+			name:      "unchanged",
+			endpoints: endpoints("weight=50", "weight=100", "weight=100"),
+			want:      map[string]naming.Operation{},
+		},
+		{
+			name:      "delete",
+			endpoints: endpoints("weight=50", "weight=100"),
+			want:      map[string]naming.Operation{"127.0.0.1:9303": naming.Delete},
+		},
+	}
+	w := &watcher{zkResolver: RegistryResolve("svc", "memory://diff", ""), servers: make(map[string]string)}
+	for _, step := range steps {
+		got := make(map[string]naming.Operation)
+		for _, update := range w.diff(step.endpoints) {
+			got[update.Addr] = update.Op
+		}
+		if len(got) != len(step.want) {
+			t.Fatalf("%s: diff() = %v, want %v", step.name, got, step.want)
+		}
+		for addr, op := range step.want {
+			if got[addr] != op {
+				t.Fatalf("%s: diff() = %v, want %v", step.name, got, step.want)
+			}
+		}
+	}
+}
+
+// TestModifyNoDuplicate Modify 之后其它实例变化，balancer 中同一个地址只有一个
+func TestModifyNoDuplicate(t *testing.T) {
+	balancers := []struct {
+		name string
+		new  func(r naming.Resolver) grpc.Balancer
+	}{
+		{name: "weighted round robin", new: func(r naming.Resolver) grpc.Balancer { return roundrobin.RoundRobin(r, true) }},
+		{name: "random", new: func(r naming.Resolver) grpc.Balancer { return random.Random(r, false) }},
+	}
+	for _, bb := range balancers {
+		t.Run(bb.name, func(t *testing.T) {
+			uw := &updatesWatcher{updates: make(chan []*naming.Update), done: make(chan struct{})}
+			defer close(uw.done)
+			b := bb.new(updatesResolver{w: uw})
+			if err := b.Start("svc", grpc.BalancerConfig{}); err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			w := &watcher{zkResolver: RegistryResolve("svc", "memory://diff", ""), servers: make(map[string]string)}
+			apply := func(updates []*naming.Update) []grpc.Address {
+				t.Helper()
+				uw.updates <- updates
+				select {
+				case addrs := <-b.Notify():
+					return addrs
+				case <-time.After(time.Second):
+					t.Fatal("balancer not notified")
+				}
+				return nil
+			}
+			check := func(addrs []grpc.Address, want int) {
+				t.Helper()
+				seen := make(map[string]bool)
+				for _, addr := range addrs {
+					if seen[addr.Addr] {
+						t.Fatalf("balancer addresses = %v, %s duplicated", addrs, addr.Addr)
+					}
+					seen[addr.Addr] = true
+				}
+				if len(seen) != want {
+					t.Fatalf("balancer addresses = %v, want %d", addrs, want)
+				}
+			}
+			check(apply(w.diff(endpoints("weight=100", "weight=100"))), 2)
+			check(apply(w.diff(endpoints("weight=50&active=1", "weight=100"))), 2)
+			check(apply(w.diff(endpoints("weight=50&active=1", "weight=100", "weight=100"))), 3)
+			// resolver 重新发送已经存在的实例时同样不重复添加
+			check(apply([]*naming.Update{{Op: naming.Add, Addr: "127.0.0.1:9301", Metadata: parseMetadata("weight=10")}}), 3)
+		})
+	}
+}
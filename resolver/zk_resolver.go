@@ -1,124 +1,327 @@
 package resolver
 
 import (
-	"github.com/docker/libkv/store"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/resolver"
 	"net/url"
+	"openWebSF/config"
+	"openWebSF/registry"
 	"openWebSF/utils"
-	"openWebSF/utils/zk"
+	"openWebSF/utils/tlsutil"
+	"strings"
+	"sync"
 	"time"
 )
 
 const scheme = "zookeeper"
 
+// 每个 scheme 只注册一个 builder，服务名和分组从 target 中解析，多个 client 可以共存
+var builders = struct {
+	sync.Mutex
+	m            map[string]*zookeeperBuilder
+	snapshotDirs map[string]string // key 为 grpc.Dial 使用的 target
+	instances    map[string]*tlsutil.Instances
+}{
+	m:            make(map[string]*zookeeperBuilder),
+	snapshotDirs: make(map[string]string),
+	instances:    make(map[string]*tlsutil.Instances),
+}
+
+// zookeeperBuilder target 格式为 scheme://注册中心地址/group/serviceName，例如：
+//
+//	zookeeper://zk1:2181,zk2:2181/default/wosf.hello.v1.helloService
+//	etcd://127.0.0.1:2379/default/wosf.hello.v1.helloService
+//	zookeeper://zk1:2181/bj,sh/wosf.hello.v1.helloService
+//
+// 多个分组用 "," 分隔并按优先级排列，排在前面的分组没有可用的实例时使用下一个分组
+// 注册中心地址中的 "/" 需要转义为 %2F，例如 file://%2Fpath%2Fservices.yaml/default/serviceName
 type zookeeperBuilder struct {
-	name string
+	scheme string
 }
 
 func (zkb *zookeeperBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	groups, serviceName := parseEndpoint(target.Endpoint)
+	if serviceName == "" {
+		return nil, fmt.Errorf("resolver target %s://%s/%s must specify service name", target.Scheme, target.Authority, target.Endpoint)
+	}
+	servers, err := url.PathUnescape(target.Authority)
+	if err != nil {
+		return nil, err
+	}
+
+	builders.Lock()
+	snapshotDir := builders.snapshotDirs[targetString(target)]
+	instances := targetInstances(targetString(target))
+	builders.Unlock()
+
 	r := &zookeeperResolver{
 		target:      target,
 		cc:          cc,
-		serviceName: zkb.name,
-	}
-	if nil == r.zk {
-		if cli, err := zk.New(target.Endpoint); err != nil {
-			logrus.Fatalln("libkv NewStore failed:", err)
-			return nil, err
-		} else {
-			r.zk = cli
-		}
+		serviceName: serviceName,
+		groups:      groups,
+		addr:        zkb.scheme + "://" + servers,
+		snapshot:    newSnapshot(snapshotDir, serviceName, groups[0]),
+		instances:   instances,
+		resolveNow:  make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
 	}
 
+	cc.NewServiceConfig(healthCheckServiceConfig(serviceName))
 	go r.watch()
 	return r, nil
 }
 
 func (zkb *zookeeperBuilder) Scheme() string {
-	return scheme
+	return zkb.scheme
 }
 
 type zookeeperResolver struct {
 	target      resolver.Target
 	cc          resolver.ClientConn
 	serviceName string
-	zk          *zk.Client
+	groups      []string
+	addr        string
+	registry    registry.Registry // 只在 watch goroutine 中访问
+	snapshot    *snapshot
+	instances   *tlsutil.Instances
+	resolved    bool // 是否已经从注册中心获取到地址
+	resolveNow  chan struct{}
+	stopCh      chan struct{}
+	once        sync.Once
 }
 
-func (*zookeeperResolver) ResolveNow(o resolver.ResolveNowOption) {}
-
-func (*zookeeperResolver) Close() {}
-
-func newBuilder(serviceName string) *zookeeperBuilder {
-	return &zookeeperBuilder{
-		name: serviceName,
+// ResolveNow grpc 连接失败时调用，通知 watch goroutine 重新 list 服务的地址
+func (r *zookeeperResolver) ResolveNow(o resolver.ResolveNowOption) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
 	}
 }
 
+// Close 停止 watch，注册中心的连接在 watch goroutine 退出时关闭
+func (r *zookeeperResolver) Close() {
+	r.once.Do(func() {
+		close(r.stopCh)
+	})
+}
+
+// watch 不断 watch 服务的地址直到 Close，与注册中心的连接断开之后按照 backoff 重试
+// 注册中心不可用并且还没有地址时先使用快照中的地址，注册中心恢复之后再更新为最新的地址；
+// 注册中心中不存在该服务时地址列表为空，不使用快照，按照 backoff 重试直到服务注册
 func (r *zookeeperResolver) watch() {
-	prefix := utils.ServicePrefix(r.serviceName)
-	if pairs, err := r.zk.List(prefix); err == store.ErrKeyNotFound {
-		logrus.Errorf("watcher list %s failed, error: %v", prefix, err)
-		time.Sleep(3 * time.Second)
-		return
-	} else if err != nil {
-		logrus.Errorf("watcher list %s failed, error: %v", prefix, err)
-		return
-	} else {
-		addrs := make([]resolver.Address, 0)
-		for _, v := range pairs {
-			addr, metadata, err := getServerInfo(v)
-			if err != nil {
-				continue
+	defer func() {
+		if r.registry != nil {
+			r.registry.Close()
+		}
+	}()
+
+	backoff := retryInterval
+	for {
+		event, err := r.listAndWatch()
+		if err != nil {
+			logrus.Errorf("resolver watch service %s failed, error: %v", r.serviceName, err)
+			if !r.resolved {
+				if endpoints, err := r.snapshot.load(); err == nil && len(endpoints) > 0 {
+					r.newAddress(endpoints)
+				}
+			}
+			select {
+			case <-time.After(backoff):
+			case <-r.stopCh:
+				return
 			}
-			addrs = append(addrs, resolver.Address{
-				Addr:     addr,
-				Metadata: metadata,
-				Type:     resolver.Backend,
-			})
+			if backoff *= 2; backoff > maxRetryInterval {
+				backoff = maxRetryInterval
+			}
+			continue
+		}
+		backoff = retryInterval
+
+		if !r.recv(event) {
+			return
+		}
+		// watch 异常结束（例如与注册中心的连接断开），重新 list 并 watch
+		logrus.Warnf("resolver watch service %s stopped, retry", r.serviceName)
+	}
+}
+
+// listAndWatch 连接注册中心，更新服务当前所有的地址并开始 watch
+func (r *zookeeperResolver) listAndWatch() (<-chan []*registry.Endpoint, error) {
+	if r.registry == nil {
+		reg := registry.Register(r.addr)
+		if reg == nil {
+			return nil, errRegistryUnavailable
 		}
-		r.cc.NewAddress(addrs)
+		r.registry = reg
 	}
-	stopCh := make(chan struct{})
-	if event, err := r.zk.WatchTree(prefix, stopCh); err != nil {
-		logrus.Errorf("watcher watchtree key %s failed, error: %v\n", prefix, err)
-		return
-	} else {
-		addrs := getUpdates(event)
-		r.cc.NewAddress(addrs)
+	if err := r.list(); err != nil {
+		return nil, err
 	}
+	return registry.WatchGroups(r.registry, r.serviceName, r.stopCh, r.groups)
+}
 
+func (r *zookeeperResolver) list() error {
+	endpoints, err := registry.ListGroups(r.registry, r.serviceName, r.groups)
+	if err == registry.ErrNotFound {
+		// 注册中心可用但不存在该服务（例如所有实例都已删除），地址列表为空，不再使用快照中的地址
+		r.update(nil)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	r.update(endpoints)
+	return nil
 }
 
-func getUpdates(kv <-chan []*store.KVPair) []resolver.Address {
-	select {
-	case pairs := <-kv:
-		updates := make([]resolver.Address, 0)
-		for _, pair := range pairs {
-			addr, metadata, err := getServerInfo(pair)
-			if err != nil {
-				continue
+// recv 接收 watch 的事件，返回 false 表示 resolver 已经 Close
+func (r *zookeeperResolver) recv(event <-chan []*registry.Endpoint) bool {
+	for {
+		select {
+		case endpoints, ok := <-event:
+			if !ok {
+				return true
 			}
-			updates = append(updates, resolver.Address{
-				Addr:     addr,
-				Type:     resolver.Backend,
-				Metadata: metadata,
-			})
+			r.update(endpoints)
+		case <-r.resolveNow:
+			if err := r.list(); err != nil {
+				logrus.Errorf("resolver list service %s failed, error: %v", r.serviceName, err)
+			}
+		case <-r.stopCh:
+			return false
 		}
-		return updates
 	}
 }
 
-func getServerInfo(pair *store.KVPair) (string, string, error) {
-	key, err := url.QueryUnescape(pair.Key)
+func (r *zookeeperResolver) update(endpoints []*registry.Endpoint) {
+	r.resolved = true
+	r.snapshot.save(endpoints)
+	r.newAddress(endpoints)
+}
+
+// newAddress 先更新实例是否要求 TLS，再通知 grpc 建立连接
+func (r *zookeeperResolver) newAddress(endpoints []*registry.Endpoint) {
+	addrs := toAddresses(endpoints)
+	r.instances.Update(requireTLS(addrs))
+	r.cc.NewAddress(addrs)
+}
+
+func toAddresses(endpoints []*registry.Endpoint) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addrs = append(addrs, resolver.Address{
+			Addr:     endpoint.Addr,
+			Type:     resolver.Backend,
+			Metadata: parseMetadata(endpoint.Metadata),
+		})
+	}
+	return addrs
+}
+
+// requireTLS 返回每个地址是否要求 TLS，客户端建立连接时据此选择 TLS 或者明文连接
+func requireTLS(addrs []resolver.Address) map[string]bool {
+	tls := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		meta, _ := addr.Metadata.(config.MetaDataInner)
+		tls[addr.Addr] = meta.TLS == config.MetaTLS
+	}
+	return tls
+}
+
+// parseMetadata 将注册中心中的 metadata 字符串解析为 config.MetaDataInner，balancer 根据其中的 Weight 和 Active 选择实例
+func parseMetadata(metadata string) config.MetaDataInner {
+	meta, err := config.ParseMetaDataInner(metadata)
 	if err != nil {
-		logrus.Errorf("url.QueryUnescape failed.", err)
-		return "", "", err
+		logrus.Warnf("metadata[%s] invalid, use default value, error: %v", metadata, err)
+	}
+	return meta
+}
+
+// healthCheckServiceConfig 开启客户端的 health check，balancer 只选择 health 状态为 SERVING 的实例
+func healthCheckServiceConfig(serviceName string) string {
+	return fmt.Sprintf(`{"healthCheckConfig":{"serviceName":%q}}`, serviceName)
+}
+
+// Target 返回 grpc.Dial 使用的 target，addr 为注册中心地址，不带 scheme 时默认为 zookeeper
+// groups 按优先级排列，为空时使用 config.Default.Group
+func Target(addr string, serviceName string, groups ...string) string {
+	s, servers := utils.ParseRegistryAddr(addr)
+	if s == "" {
+		s = scheme
+	}
+	if len(groups) == 0 {
+		groups = []string{config.Default.Group}
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", s, escapeAuthority(servers), strings.Join(groups, ","), serviceName)
+}
+
+// Init 注册 target 的 scheme 对应的 resolver，同一个 scheme 只注册一次
+// snapshotDir 为该 target 使用的快照目录，为空时使用 config.Default.SnapshotDir
+// 返回该 target 的实例是否要求 TLS，相同 target 的 client 共用
+func Init(target string, snapshotDir string) *tlsutil.Instances {
+	t := parseTarget(target)
+	builders.Lock()
+	defer builders.Unlock()
+	if snapshotDir != "" {
+		builders.snapshotDirs[targetString(t)] = snapshotDir
+	}
+	instances := targetInstances(targetString(t))
+	if _, ok := builders.m[t.Scheme]; ok {
+		return instances
+	}
+	b := &zookeeperBuilder{
+		scheme: t.Scheme,
+	}
+	builders.m[t.Scheme] = b
+	resolver.Register(b)
+	return instances
+}
+
+// targetInstances 调用时需要持有 builders 的锁
+func targetInstances(target string) *tlsutil.Instances {
+	instances, ok := builders.instances[target]
+	if !ok {
+		instances = tlsutil.NewInstances()
+		builders.instances[target] = instances
+	}
+	return instances
+}
+
+// parseTarget 与 grpc 解析 target 的方式相同：scheme://authority/endpoint
+func parseTarget(target string) resolver.Target {
+	var t resolver.Target
+	t.Scheme, t.Endpoint = utils.ParseRegistryAddr(target)
+	if i := strings.Index(t.Endpoint, "/"); i >= 0 {
+		t.Authority, t.Endpoint = t.Endpoint[:i], t.Endpoint[i+1:]
+	}
+	return t
+}
+
+func targetString(t resolver.Target) string {
+	return fmt.Sprintf("%s://%s/%s", t.Scheme, t.Authority, t.Endpoint)
+}
+
+// parseEndpoint 解析 target 中的 group/serviceName，不带 group 时使用默认的分组
+func parseEndpoint(endpoint string) ([]string, string) {
+	endpoint = strings.Trim(endpoint, "/")
+	i := strings.LastIndex(endpoint, "/")
+	if i < 0 {
+		return []string{config.Default.Group}, endpoint
+	}
+	groups := make([]string, 0)
+	for _, group := range strings.Split(endpoint[:i], ",") {
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		groups = append(groups, config.Default.Group)
 	}
-	return key, string(pair.Value), nil
+	return groups, endpoint[i+1:]
 }
 
-func Init(serviceName string) {
-	resolver.Register(newBuilder(serviceName))
+// escapeAuthority 转义注册中心地址中的 "/"，保证 grpc 能正确解析 target 的 authority
+func escapeAuthority(servers string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F").Replace(servers)
 }
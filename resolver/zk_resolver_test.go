@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"google.golang.org/grpc/resolver"
+	"io/ioutil"
+	"openWebSF/config"
+	"openWebSF/registry"
+	"os"
+	"testing"
+	"time"
+)
+
+// addressesCC 记录 resolver 通知的地址
+type addressesCC struct {
+	addrs chan []resolver.Address
+}
+
+func (cc *addressesCC) NewAddress(addrs []resolver.Address) { cc.addrs <- addrs }
+func (cc *addressesCC) NewServiceConfig(serviceConfig string) {}
+
+func (cc *addressesCC) next(t *testing.T) []string {
+	t.Helper()
+	select {
+	case addrs := <-cc.addrs:
+		got := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			got = append(got, addr.Addr)
+		}
+		return got
+	case <-time.After(2 * retryInterval):
+		t.Fatal("resolver not notified")
+	}
+	return nil
+}
+
+// saveSnapshot 在临时目录中保存服务的快照，返回快照目录
+func saveSnapshot(t *testing.T, serviceName string, addrs ...string) string {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := make([]*registry.Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoints = append(endpoints, &registry.Endpoint{Addr: addr, Metadata: config.DefaultMetaDataInner.String()})
+	}
+	newSnapshot(dir, serviceName, config.Default.Group).save(endpoints)
+	return dir
+}
+
+func buildResolver(t *testing.T, scheme string, target string, snapshotDir string) (*addressesCC, resolver.Resolver) {
+	Init(target, snapshotDir)
+	cc := &addressesCC{addrs: make(chan []resolver.Address, 10)}
+	r, err := (&zookeeperBuilder{scheme: scheme}).Build(parseTarget(target), cc, resolver.BuildOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc, r
+}
+
+// TestWatchNotFound 注册中心中不存在该服务时地址为空，不使用快照中的地址，服务注册之后更新
+func TestWatchNotFound(t *testing.T) {
+	const addr = "memory://watch_not_found"
+	dir := saveSnapshot(t, "svc", "127.0.0.1:9309")
+	defer os.RemoveAll(dir)
+
+	cc, r := buildResolver(t, "memory", Target(addr, "svc"), dir)
+	defer r.Close()
+	if got := cc.next(t); len(got) != 0 {
+		t.Fatalf("addresses = %v, want empty", got)
+	}
+
+	reg, err := registry.New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	config.Default.LocalIP = "127.0.0.1"
+	if err := reg.RegisterService("svc", 9301, config.DefaultMetaDataInner); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		got := cc.next(t)
+		if len(got) == 0 {
+			continue
+		}
+		if len(got) != 1 || got[0] != "127.0.0.1:9301" {
+			t.Fatalf("addresses = %v, want [127.0.0.1:9301]", got)
+		}
+		return
+	}
+}
+
+// TestWatchUnavailable 注册中心不可用时使用快照中的地址
+func TestWatchUnavailable(t *testing.T) {
+	dir := saveSnapshot(t, "svc", "127.0.0.1:9309")
+	defer os.RemoveAll(dir)
+
+	cc, r := buildResolver(t, "unavailable", Target("unavailable://127.0.0.1:1", "svc"), dir)
+	defer r.Close()
+	if got := cc.next(t); len(got) != 1 || got[0] != "127.0.0.1:9309" {
+		t.Fatalf("addresses = %v, want snapshot [127.0.0.1:9309]", got)
+	}
+}
+
+// TestWatcherNotFound v1 的 watcher 在服务不存在时同样不使用快照
+func TestWatcherNotFound(t *testing.T) {
+	const addr = "memory://watcher_not_found"
+	dir := saveSnapshot(t, "svc", "127.0.0.1:9309")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(addr, RegistryResolve("svc", addr, dir))
+	defer w.Close()
+	type result struct {
+		updates []string
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		updates, err := w.Next()
+		addrs := make([]string, 0, len(updates))
+		for _, update := range updates {
+			addrs = append(addrs, update.Addr)
+		}
+		results <- result{addrs, err}
+	}()
+	select {
+	case res := <-results:
+		t.Fatalf("Next() = %v, %v before the service registered", res.updates, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	reg, err := registry.New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	config.Default.LocalIP = "127.0.0.1"
+	if err := reg.RegisterService("svc", 9301, config.DefaultMetaDataInner); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-results:
+		if res.err != nil || len(res.updates) != 1 || res.updates[0] != "127.0.0.1:9301" {
+			t.Fatalf("Next() = %v, %v, want [127.0.0.1:9301]", res.updates, res.err)
+		}
+	case <-time.After(2 * retryInterval):
+		t.Fatal("Next() not returned after the service registered")
+	}
+}
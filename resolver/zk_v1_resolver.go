@@ -1,27 +1,51 @@
 package resolver
 
 import (
-	"github.com/sirupsen/logrus"
+	"errors"
 	"google.golang.org/grpc/naming"
-	"openWebSF/utils/zk"
+	"openWebSF/utils/tlsutil"
 )
 
+var errRegistryUnavailable = errors.New("connected to registry failed")
+
 type zookeeper struct {
-	name string // 服务名
+	name        string   // 服务名
+	addr        string   // 注册中心地址，为空时使用 Resolve 的 target
+	snapshotDir string   // 服务地址快照的目录，为空时使用 config.Default.SnapshotDir
+	groups      []string // 按优先级排列的分组，为空时使用 config.Default.Group
+	instances   *tlsutil.Instances
 }
 
+// ZookeeperResolve 使用 Resolve 的 target 作为 zookeeper 地址
 func ZookeeperResolve(name string) *zookeeper {
 	return &zookeeper{
-		name: name,
+		name:      name,
+		instances: tlsutil.NewInstances(),
 	}
 }
 
-func (r *zookeeper) Resolve(target string) (naming.Watcher, error) {
-	cli, err := zk.New(target)
-	if err != nil {
-		logrus.Fatalln("connected to zk failed!")
-		return nil, err
+// RegistryResolve 根据注册中心地址的 scheme 选择注册中心，例如 zookeeper:///127.0.0.1:2181
+// groups 按优先级排列，排在前面的分组没有可用的实例时使用下一个分组
+func RegistryResolve(name string, addr string, snapshotDir string, groups ...string) *zookeeper {
+	return &zookeeper{
+		name:        name,
+		addr:        addr,
+		snapshotDir: snapshotDir,
+		groups:      groups,
+		instances:   tlsutil.NewInstances(),
 	}
+}
 
-	return NewWatcher(cli, r), nil
+// Instances 返回实例是否要求 TLS，Resolve 返回的 watcher 更新
+func (r *zookeeper) Instances() *tlsutil.Instances {
+	return r.instances
+}
+
+func (r *zookeeper) Resolve(target string) (naming.Watcher, error) {
+	addr := r.addr
+	if addr == "" {
+		addr = target
+	}
+	// 注册中心在 watcher 中连接，连接失败时使用快照中的地址并且不断重试
+	return NewWatcher(addr, r), nil
 }
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"openWebSF/config"
+	"openWebSF/config/serverConf"
+	"openWebSF/interceptor/ratelimit"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// 关闭管理接口时等待请求处理完成的最长时间
+	adminShutdownTimeout = 3 * time.Second
+	// 升级时旧进程退出之前管理接口的端口仍然被占用，新进程重试监听的间隔
+	adminRetryInterval = time.Second
+)
+
+var (
+	// readiness check 通过之前重新注册会让客户端访问还没有 ready 的实例，返回 503
+	errNotReady = errors.New("server is not ready")
+	// Shutdown 开始之后重新注册会让已经删除的实例重新出现在注册中心，返回 409
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+type serviceStatus struct {
+	Name           string `json:"name"`
+	Group          string `json:"group"`
+	NoRegistration bool   `json:"no_registration"`
+	Registered     bool   `json:"registered"`
+	Metadata       string `json:"metadata"` // 注册到注册中心的 metadata
+	Weight         int    `json:"weight"`
+	Active         int    `json:"active"`
+	Health         string `json:"health"` // grpc health check 的状态
+}
+
+type adminStatus struct {
+	Port      int                                `json:"port"`
+	Advertise string                             `json:"advertise"` // 注册到注册中心的地址
+	Registry  string                             `json:"registry"`
+	LimitQPS  int                                `json:"limit_qps"`
+	MethodQPS map[string]int                     `json:"method_qps"`
+	CallerQPS map[string]int                     `json:"caller_qps"`
+	Cluster   map[string]ratelimit.ClusterStatus `json:"cluster"`
+	Adaptive  ratelimit.AdaptiveStatus           `json:"adaptive"`
+	Services  []serviceStatus                    `json:"services"`
+}
+
+// startAdmin 启动管理接口，addr 为空时不启动，接口如下（name 为空时操作所有注册到注册中心的服务）：
+//
+//	GET  /status                                  服务、注册状态、metadata 、QPS 上限（包括按方法、按调用方和集群限流）和自适应并发限制的状态
+//	POST /services/weight?name=xxx&weight=50      修改权重并更新注册中心中的值
+//	POST /services/offline?name=xxx               下线，注册中心中的 active 修改为 1，客户端不再访问
+//	POST /services/online?name=xxx                上线
+//	POST /services/deregister?name=xxx            从注册中心删除
+//	POST /services/register?name=xxx              重新注册到注册中心，ready 之前返回 503，Shutdown 开始之后返回 409
+//	POST /shutdown                                优雅退出
+func (s *server) startAdmin(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/services/weight", s.handleWeight)
+	mux.HandleFunc("/services/offline", s.handleActive(config.MetaActiveOffline))
+	mux.HandleFunc("/services/online", s.handleActive(config.MetaActiveOnline))
+	mux.HandleFunc("/services/deregister", s.handleDeregister)
+	mux.HandleFunc("/services/register", s.handleRegister)
+	mux.HandleFunc("/shutdown", s.handleShutdown)
+	s.admin = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func(admin *http.Server) {
+		for {
+			logrus.Infof("starting admin server at %s", addr)
+			err := admin.ListenAndServe()
+			if err == nil || err == http.ErrServerClosed {
+				return
+			}
+			logrus.Errorf("admin server at %s failed, error: %v", addr, err)
+			if !s.inherited {
+				return
+			}
+			select {
+			case <-time.After(adminRetryInterval):
+			case <-s.done:
+				return
+			}
+		}
+	}(s.admin)
+}
+
+func (s *server) stopAdmin() {
+	if s.admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := s.admin.Shutdown(ctx); err != nil {
+		logrus.Warnf("shutdown admin server failed, error: %v", err)
+	}
+}
+
+func (s *server) status() adminStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := adminStatus{
+		Port:      s.port,
+		Advertise: net.JoinHostPort(config.Default.LocalIP, strconv.Itoa(s.port)),
+		Registry:  serverConf.Conf.RegisterAddr,
+		LimitQPS:  s.limiter.QPS(),
+		MethodQPS: s.limiter.Methods(),
+		CallerQPS: s.limiter.Callers(),
+		Cluster:   s.limiter.Cluster(),
+		Adaptive:  s.adaptive.Status(),
+		Services:  make([]serviceStatus, 0, len(s.services)),
+	}
+	for _, service := range s.services {
+		st.Services = append(st.Services, serviceStatus{
+			Name:           service.Name,
+			Group:          service.Group,
+			NoRegistration: service.NoRegistration,
+			Registered:     service.registered,
+			Metadata:       service.metaInner.String(),
+			Weight:         service.metaInner.Weight,
+			Active:         service.metaInner.Active,
+			Health:         s.healthStatus(service.Name),
+		})
+	}
+	sort.Slice(st.Services, func(i, j int) bool {
+		return st.Services[i].Name < st.Services[j].Name
+	})
+	return st
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *server) handleWeight(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("weight[%s] invalid", r.FormValue("weight")))
+		return
+	}
+	s.updateMetadata(w, r, func(meta *config.MetaDataInner) {
+		meta.Weight = weight
+	})
+}
+
+func (s *server) handleActive(active int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkPost(w, r) {
+			return
+		}
+		s.updateMetadata(w, r, func(meta *config.MetaDataInner) {
+			meta.Active = active
+		})
+	}
+}
+
+func (s *server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	s.forEachService(w, r, s.unregisterService)
+}
+
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	s.forEachService(w, r, func(name string) error {
+		// 与 Shutdown 中删除注册信息使用同一个锁，检查通过之后注册的服务一定会在 Shutdown 时被删除
+		select {
+		case <-s.done:
+			return errShuttingDown
+		default:
+		}
+		if !s.ready {
+			return errNotReady
+		}
+		return s.registerService(name)
+	})
+}
+
+func (s *server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	logrus.Infof("shutdown requested by admin from %s", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]string{"result": "shutting down"})
+	go s.Shutdown()
+}
+
+// updateMetadata 修改服务的 metadata，已经注册的服务同时更新注册中心中的值
+func (s *server) updateMetadata(w http.ResponseWriter, r *http.Request, update func(meta *config.MetaDataInner)) {
+	s.forEachService(w, r, func(name string) error {
+		service := s.services[name]
+		update(&service.metaInner)
+		s.services[name] = service
+		s.updateHealth(name)
+		if !service.registered {
+			return nil
+		}
+		return s.registerService(name)
+	})
+}
+
+// forEachService 对请求参数 name 指定的服务执行 f，name 为空时对所有注册到注册中心的服务执行，f 执行时持有 s.mu
+func (s *server) forEachService(w http.ResponseWriter, r *http.Request, f func(name string) error) {
+	name := r.FormValue("name")
+	s.mu.Lock()
+	names := make([]string, 0, len(s.services))
+	if name != "" {
+		if _, ok := s.services[name]; !ok {
+			s.mu.Unlock()
+			writeError(w, http.StatusNotFound, fmt.Errorf("service[%s] not found", name))
+			return
+		}
+		names = append(names, name)
+	} else {
+		for n, service := range s.services {
+			if !service.NoRegistration {
+				names = append(names, n)
+			}
+		}
+	}
+	for _, n := range names {
+		if err := f(n); err != nil {
+			s.mu.Unlock()
+			logrus.Warnf("admin %s service[%s] failed, error: %v", r.URL.Path, n, err)
+			writeError(w, errorCode(err), err)
+			return
+		}
+		logrus.Infof("admin %s service[%s] success", r.URL.Path, n)
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func errorCode(err error) int {
+	switch err {
+	case errNotReady:
+		return http.StatusServiceUnavailable
+	case errShuttingDown:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func checkPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Warnf("write admin response failed, error: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
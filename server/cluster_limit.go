@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"openWebSF/config"
+	"openWebSF/registry"
+	"time"
+)
+
+// 监听注册中心失败或者监听中断之后重试的间隔
+const clusterWatchRetryInterval = 3 * time.Second
+
+// watchCluster 对配置了集群限流的服务监听注册中心中的实例数，实例上线或下线时重新计算本实例的份额，已经监听的服务不重复监听
+func (s *server) watchCluster(budgets map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, budget := range budgets {
+		if budget <= 0 || s.clusterWatched[name] {
+			continue
+		}
+		service, ok := s.services[name]
+		if !ok {
+			logrus.Warnf("cluster rate limit of service[%s] ignored, service not found%s", name, s.serviceHint(name))
+			continue
+		}
+		if service.NoRegistration || s.register == nil {
+			logrus.Warnf("service[%s] is not registered to registration center, cluster rate limit uses the whole budget %d", name, budget)
+			continue
+		}
+		s.clusterWatched[name] = true
+		go s.watchInstances(service)
+	}
+}
+
+// watchInstances 按注册中心中在线的实例数分配份额，下线的实例不接收请求，不参与分配
+func (s *server) watchInstances(service ServiceConfig) {
+	for {
+		ch, err := s.register.Watch(service.Name, s.done, service.Group)
+		if err != nil {
+			logrus.Warnf("watch instances of service[%s] failed, error: %v", service.Name, err)
+		} else {
+			for endpoints := range ch {
+				online := onlineInstances(endpoints)
+				s.limiter.SetInstances(service.Name, online)
+				logrus.Infof("service[%s] has %d instances, %d online, cluster rate limit: %+v",
+					service.Name, len(endpoints), online, s.limiter.Cluster()[service.Name])
+			}
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(clusterWatchRetryInterval):
+		}
+	}
+}
+
+// onlineInstances 返回在线的实例数，最少为 1（本实例尚未注册或者所有实例都已下线）
+func onlineInstances(endpoints []*registry.Endpoint) int {
+	online := 0
+	for _, endpoint := range endpoints {
+		if meta, _ := config.ParseMetaDataInner(endpoint.Metadata); meta.Online() {
+			online++
+		}
+	}
+	if online < 1 {
+		return 1
+	}
+	return online
+}
+
+// serviceHint 集群限流的 key 是 .proto 中的服务名时提示使用 ServiceConfig.Name，调用时需要持有 s.mu
+func (s *server) serviceHint(name string) string {
+	for _, service := range s.services {
+		if service.protoName == name {
+			return fmt.Sprintf(", use service name %s instead of proto service name", service.Name)
+		}
+	}
+	return ""
+}
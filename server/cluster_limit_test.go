@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"openWebSF/config"
+	"openWebSF/config/serverConf"
+	"openWebSF/example/pb"
+	"openWebSF/registry"
+	"testing"
+	"time"
+)
+
+type helloServer struct{}
+
+func (helloServer) HelloWorld(ctx context.Context, req *pb.HelloRequest) (*pb.HelloRespone, error) {
+	return &pb.HelloRespone{}, nil
+}
+
+func endpoints(actives ...int) []*registry.Endpoint {
+	endpoints := make([]*registry.Endpoint, 0, len(actives))
+	for i, active := range actives {
+		meta := config.DefaultMetaDataInner
+		meta.Active = active
+		endpoints = append(endpoints, &registry.Endpoint{Addr: fmt.Sprintf("127.0.0.1:%d", 9301+i), Metadata: meta.String()})
+	}
+	return endpoints
+}
+
+func TestOnlineInstances(t *testing.T) {
+	const on, off = config.MetaActiveOnline, config.MetaActiveOffline
+	tests := []struct {
+		name      string
+		endpoints []*registry.Endpoint
+		want      int
+	}{
+		{name: "none", want: 1},
+		{name: "all online", endpoints: endpoints(on, on, on), want: 3},
+		{name: "mixed", endpoints: endpoints(on, off, on, off), want: 2},
+		{name: "all offline", endpoints: endpoints(off, off), want: 1},
+		{name: "default metadata", endpoints: []*registry.Endpoint{{Addr: "127.0.0.1:9301"}}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onlineInstances(tt.endpoints); got != tt.want {
+				t.Fatalf("onlineInstances() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClusterLimitOnline 实例下线之后剩余在线实例的份额增加
+func TestClusterLimitOnline(t *testing.T) {
+	const addr = "memory://cluster_online"
+	const service = "wosf.hello.v1.helloService"
+	config.Default.LocalIP = "127.0.0.1"
+	conf := serverConf.Conf
+	defer func() { serverConf.Conf = conf }()
+	serverConf.Conf.RegisterAddr = addr
+	serverConf.Conf.RateLimit.Cluster = map[string]int{service: 90}
+
+	s, err := NewServerE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.doneOnce.Do(func() { close(s.done) })
+	if err := s.RegisterE(ServiceConfig{Name: service, RegisterService: pb.RegisterHelloServiceServer, Server: helloServer{}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := registry.New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for port := 9301; port <= 9303; port++ {
+		r.RegisterService(service, port, config.DefaultMetaDataInner)
+	}
+	s.watchCluster(serverConf.Conf.RateLimit.Cluster)
+
+	wait := func(instances, qps int) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			status := s.limiter.Cluster()[service]
+			if status.Instances == instances && status.QPS == qps {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cluster status = %+v, want %d instances, qps %d", status, instances, qps)
+			}
+		}
+	}
+	wait(3, 30)
+
+	offline := config.DefaultMetaDataInner
+	offline.Active = config.MetaActiveOffline
+	r.RegisterService(service, 9303, offline)
+	wait(2, 45)
+	r.RegisterService(service, 9302, offline)
+	wait(1, 90)
+}
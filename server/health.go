@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// servingStatus 服务的 health 状态：不注册到注册中心的服务为 SERVING，其它服务注册到注册中心并且在线（active=0）时为 SERVING
+func servingStatus(service ServiceConfig) healthpb.HealthCheckResponse_ServingStatus {
+	if service.metaInner.Online() && (service.NoRegistration || service.registered) {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// updateHealth 服务的注册状态或者 metadata 修改之后更新 health 状态，调用时必须持有 s.mu
+// readiness check 通过之前所有服务的状态都为 NOT_SERVING，Shutdown 开始之后不再修改
+func (s *server) updateHealth(name string) {
+	if service, ok := s.services[name]; ok {
+		status := servingStatus(service)
+		if !s.ready {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		s.health.SetServingStatus(name, status)
+	}
+}
+
+// healthStatus 返回 health check 的当前状态
+func (s *server) healthStatus(name string) string {
+	resp, err := s.health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: name})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN.String()
+	}
+	return resp.Status.String()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/grpc-ecosystem/go-grpc-middleware/recovery"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"openWebSF/config/serverConf"
+	"openWebSF/interceptor/monitor"
+	"openWebSF/interceptor/ratelimit"
+	"openWebSF/interceptor/trace"
+	"openWebSF/utils"
+	"runtime/debug"
+	"time"
+)
+
+const DefaultMonitorThreshold = 10
+
+// AddUnaryInterceptor 添加所有服务共用的 unary interceptor，必须在 Start 之前调用
+func (s *server) AddUnaryInterceptor(interceptor ...grpc.UnaryServerInterceptor) *server {
+	s.unaryInts = append(s.unaryInts, interceptor...)
+	return s
+}
+
+// AddStreamInterceptor 添加所有服务共用的 stream interceptor，必须在 Start 之前调用
+func (s *server) AddStreamInterceptor(interceptor ...grpc.StreamServerInterceptor) *server {
+	s.streamInts = append(s.streamInts, interceptor...)
+	return s
+}
+
+// AddUnaryInterceptor 添加只对该服务生效的 unary interceptor
+func (c *ServiceConfig) AddUnaryInterceptor(interceptor ...grpc.UnaryServerInterceptor) *ServiceConfig {
+	interceptors := make([]grpc.UnaryServerInterceptor, 0)
+	if c.UnaryInt != nil {
+		interceptors = append(interceptors, c.UnaryInt)
+	}
+	interceptors = append(interceptors, interceptor...)
+	c.UnaryInt = grpc_middleware.ChainUnaryServer(interceptors...)
+	return c
+}
+
+// AddStreamInterceptor 添加只对该服务生效的 stream interceptor
+func (c *ServiceConfig) AddStreamInterceptor(interceptor ...grpc.StreamServerInterceptor) *ServiceConfig {
+	interceptors := make([]grpc.StreamServerInterceptor, 0)
+	if c.StreamInt != nil {
+		interceptors = append(interceptors, c.StreamInt)
+	}
+	interceptors = append(interceptors, interceptor...)
+	c.StreamInt = grpc_middleware.ChainStreamServer(interceptors...)
+	return c
+}
+
+// unaryInterceptors 按以下顺序执行（前面的在外层）：
+//
+//  1. panic recovery，panic 时记录日志并返回 codes.Internal
+//  2. trace id，请求中没有 trace id 时生成一个新的
+//  3. monitor 日志，耗时大于等于 monitorThreshold 的请求
+//  4. QPS 限流（limitQPS 和 rateLimit），返回 codes.ResourceExhausted
+//  5. 自适应并发限制（rateLimit.adaptive），返回 codes.Unavailable
+//  6. server.AddUnaryInterceptor 添加的 interceptor
+//  7. ServiceConfig.UnaryInt，只对该服务的方法生效，按 .proto 中的服务名匹配请求的 FullMethod
+func (s *server) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	interceptors := []grpc.UnaryServerInterceptor{
+		grpc_recovery.UnaryServerInterceptor(grpc_recovery.WithRecoveryHandler(recoveryHandler)),
+		trace.UnaryServerInterceptor(),
+		monitor.UnaryServerMonitorLog(monitorThreshold()),
+		ratelimit.UnaryServerInterceptor(s.limiter),
+		ratelimit.AdaptiveUnaryServerInterceptor(s.adaptive),
+	}
+	interceptors = append(interceptors, s.unaryInts...)
+
+	services := make(map[string]grpc.UnaryServerInterceptor)
+	for _, service := range s.services {
+		if service.UnaryInt != nil {
+			services[service.protoName] = service.UnaryInt
+		}
+	}
+	if len(services) > 0 {
+		interceptors = append(interceptors, func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if interceptor, ok := services[utils.MethodService(info.FullMethod)]; ok {
+				return interceptor(ctx, req, info, handler)
+			}
+			return handler(ctx, req)
+		})
+	}
+	return interceptors
+}
+
+// streamInterceptors 顺序与 unaryInterceptors 相同，stream 不受自适应并发限制，
+// recovery 之后的 streamContext 在 Shutdown 强制 Stop 时取消 stream 的 context
+func (s *server) streamInterceptors() []grpc.StreamServerInterceptor {
+	interceptors := []grpc.StreamServerInterceptor{
+		grpc_recovery.StreamServerInterceptor(grpc_recovery.WithRecoveryHandler(recoveryHandler)),
+		s.streamContext,
+		trace.StreamServerInterceptor(),
+		monitor.StreamServerMonitorLog(monitorThreshold()),
+		ratelimit.StreamServerInterceptor(s.limiter),
+	}
+	interceptors = append(interceptors, s.streamInts...)
+
+	services := make(map[string]grpc.StreamServerInterceptor)
+	for _, service := range s.services {
+		if service.StreamInt != nil {
+			services[service.protoName] = service.StreamInt
+		}
+	}
+	if len(services) > 0 {
+		interceptors = append(interceptors, func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if interceptor, ok := services[utils.MethodService(info.FullMethod)]; ok {
+				return interceptor(srv, ss, info, handler)
+			}
+			return handler(srv, ss)
+		})
+	}
+	return interceptors
+}
+
+func recoveryHandler(p interface{}) error {
+	logrus.Errorf("grpc handler panic: %v\n%s", p, debug.Stack())
+	return status.Errorf(codes.Internal, "panic: %v", p)
+}
+
+func monitorThreshold() time.Duration {
+	if serverConf.Conf.MonitorThreshold > 0 {
+		return time.Duration(serverConf.Conf.MonitorThreshold) * time.Millisecond
+	}
+	return DefaultMonitorThreshold * time.Millisecond
+}
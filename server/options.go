@@ -0,0 +1,71 @@
+package server
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"openWebSF/config/serverConf"
+	"time"
+)
+
+// AddServerOption 添加 grpc.NewServer 的参数，在配置文件中 grpc 相关的参数之后生效，必须在 Start 之前调用
+// interceptor 通过 AddUnaryInterceptor/AddStreamInterceptor 添加，不能使用 grpc.UnaryInterceptor/grpc.StreamInterceptor
+func (s *server) AddServerOption(opts ...grpc.ServerOption) *server {
+	s.serverOpts = append(s.serverOpts, opts...)
+	return s
+}
+
+// serverOptions 依次为 TLS 证书、配置文件中的参数和 AddServerOption 添加的参数，后面的参数覆盖前面的
+func (s *server) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if s.tls != nil {
+		opts = append(opts, grpc.Creds(s.tls.ServerCredentials()))
+	}
+	opts = append(opts, grpcOptions(serverConf.Conf.Grpc)...)
+	opts = append(opts, s.serverOpts...)
+	return opts
+}
+
+// grpcOptions 将配置文件中的 grpc 参数转换为 grpc.ServerOption，为 0 的参数使用 grpc 的默认值
+func grpcOptions(conf serverConf.GrpcConfig) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if conf.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(conf.MaxRecvMsgSize))
+	}
+	if conf.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(conf.MaxSendMsgSize))
+	}
+	if conf.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(conf.MaxConcurrentStreams))
+	}
+	if conf.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(conf.InitialWindowSize))
+	}
+	if conf.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(conf.InitialConnWindowSize))
+	}
+	if conf.ConnectionTimeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(millisecond(conf.ConnectionTimeout)))
+	}
+
+	ka := conf.Keepalive
+	if ka.Time > 0 || ka.Timeout > 0 || ka.MaxConnectionIdle > 0 || ka.MaxConnectionAge > 0 || ka.MaxConnectionAgeGrace > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  millisecond(ka.Time),
+			Timeout:               millisecond(ka.Timeout),
+			MaxConnectionIdle:     millisecond(ka.MaxConnectionIdle),
+			MaxConnectionAge:      millisecond(ka.MaxConnectionAge),
+			MaxConnectionAgeGrace: millisecond(ka.MaxConnectionAgeGrace),
+		}))
+	}
+	if ka.MinTime > 0 || ka.PermitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             millisecond(ka.MinTime),
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+	return opts
+}
+
+func millisecond(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
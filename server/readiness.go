@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"openWebSF/config/serverConf"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReadinessTimeout = 30000
+	// readiness check 失败之后重试的间隔
+	readinessRetryInterval = time.Second
+)
+
+var errShutdownBeforeReady = errors.New("server shutdown before ready")
+
+// ReadinessCheck 服务启动之后、注册到注册中心之前的检查，例如预热缓存、检查数据库连接，返回 nil 表示可以接收请求
+type ReadinessCheck func(ctx context.Context) error
+
+// AddReadinessCheck 添加 readiness check，所有的检查都通过之后才注册到注册中心，必须在 Start 之前调用
+func (s *server) AddReadinessCheck(check ...ReadinessCheck) *server {
+	s.readinessChecks = append(s.readinessChecks, check...)
+	return s
+}
+
+// acceptListener grpc.Server 第一次调用 Accept 时关闭 accepting，说明已经开始接收连接
+type acceptListener struct {
+	net.Listener
+	accepting chan struct{}
+	once      sync.Once
+}
+
+func (l *acceptListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		close(l.accepting)
+	})
+	return l.Listener.Accept()
+}
+
+// waitReady 等待 grpc.Server 开始接收连接并且所有的 readiness check 都通过，
+// 超过配置文件中的 readinessTimeout（单位 ms，默认 30s）、Serve 失败或者 Shutdown 时返回错误
+func (s *server) waitReady(lis *acceptListener, serveErr <-chan error) error {
+	timeout := DefaultReadinessTimeout * time.Millisecond
+	if serverConf.Conf.ReadinessTimeout > 0 {
+		timeout = time.Duration(serverConf.Conf.ReadinessTimeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case <-lis.accepting:
+	case err := <-serveErr:
+		return fmt.Errorf("serve failed before ready, error: %v", err)
+	case <-s.done:
+		return errShutdownBeforeReady
+	case <-ctx.Done():
+		return fmt.Errorf("server not accepting connections after %s", timeout)
+	}
+
+	for i, check := range s.readinessChecks {
+		for {
+			err := check(ctx)
+			if err == nil {
+				break
+			}
+			logrus.Warnf("readiness check %d failed, retry after %s, error: %v", i, readinessRetryInterval, err)
+			select {
+			case <-time.After(readinessRetryInterval):
+			case err := <-serveErr:
+				return fmt.Errorf("serve failed before ready, error: %v", err)
+			case <-s.done:
+				return errShutdownBeforeReady
+			case <-ctx.Done():
+				return fmt.Errorf("readiness check %d not passed after %s, last error: %v", i, timeout, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setReady 将所有服务的 health 状态设置为 SERVING 并注册到注册中心，任意一个服务注册失败时返回错误
+func (s *server) setReady() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = true
+	for _, service := range s.services {
+		if !service.NoRegistration {
+			if err := s.registerService(service.Name); err != nil {
+				return fmt.Errorf("register service [%s] to registration center failed, error: %v", service.Name, err)
+			}
+		}
+		s.updateHealth(service.Name)
+	}
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	return nil
+}
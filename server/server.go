@@ -11,62 +11,177 @@ import (
 	"strings"
 	"strconv"
 	"google.golang.org/grpc/reflection"
-	"time"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"openWebSF/config"
 	"fmt"
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
 	"sync"
+	"openWebSF/interceptor/ratelimit"
+	"openWebSF/utils/tlsutil"
+	"net/http"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
 )
 
 type ServiceConfig struct {
 	Name            string      // 服务名
+	Group           string      // 服务分组，默认为 NODE_CLUSTER 环境变量的值
 	NoRegistration  bool        // 是否注册到注册中心， 默认值false,即注册到注册中心
 	RegisterAddr    string      // 注册中心地址
 	RegisterService interface{} // 生成的.pb.go文件中用于向grpc注册服务的函数，例如：RegisterPingServiceServer
 	Server          interface{} // 调用Register时传入的第二个参数（实现.pb.go文件中Server interface的变量）
+	UnaryInt        grpc.UnaryServerInterceptor  // 只对该服务生效的 interceptor，在框架默认的和 server.AddUnaryInterceptor 添加的 interceptor 之后执行
+	StreamInt       grpc.StreamServerInterceptor
 	metaInner       config.MetaDataInner
+	registered      bool   // 是否已经注册到注册中心
+	protoName       string   // .proto 中的服务名（ServiceDesc.ServiceName），请求的 FullMethod 为 /protoName/method
+	methods         []string // 所有方法的完整方法名，用于检查限流配置
 }
 
 type server struct {
 	server   *grpc.Server
 	port     int // 注册端口号
+	mu       sync.Mutex // 保护 services，管理接口会修改其中的 metadata 和注册状态
 	services map[string]ServiceConfig
-	register *registry.Registry
-	qpsChan  []chan int
+	register registry.Registry
+	limiter  *ratelimit.Limiters // QPS 限流，收到 SIGUSR1 时根据配置文件修改上限
+	adaptive *ratelimit.AdaptiveLimiter // 自适应并发限制
+	admin    *http.Server
+	unaryInts  []grpc.UnaryServerInterceptor // server.AddUnaryInterceptor 添加的 interceptor
+	streamInts []grpc.StreamServerInterceptor
+	serverOpts []grpc.ServerOption // AddServerOption 添加的参数
+	tls        *tlsutil.Reloader // 配置了证书时不为 nil
+	health     *health.Server // 每个服务的 health 状态，客户端和 consul 的 health check 使用
+	readinessChecks []ReadinessCheck
+	ready      bool // 开始接收连接并且 readiness check 通过，受 mu 保护
+	clusterWatched map[string]bool // 已经监听实例数的集群限流服务
+	done     chan struct{} // Shutdown 时关闭
+	doneOnce sync.Once
+	shutdownHooks []ShutdownHook
+	shutdownOnce  sync.Once
+	forceStop     chan struct{} // GracefulStop 超时强制 Stop 时关闭
+	stopped       chan struct{} // Shutdown 执行完成之后关闭
+	listener      net.Listener  // 升级时传给新进程
+	upgradeReady  *os.File      // 从旧进程继承监听 socket 时不为 nil，ready 之后通知旧进程
+	inherited     bool          // 监听 socket 是从旧进程继承的
+	upgrading     bool          // 受 mu 保护
+	handoff       bool          // 监听 socket 已经交给新进程，Shutdown 时不从注册中心删除，受 mu 保护
+	err           error         // NewServer 和 Register 的第一个错误，Start 时返回
 }
 
+// NewServer 配置文件、证书或者注册中心有错误时不退出进程，错误在 Start 时返回，需要立即处理错误时使用 NewServerE
 func NewServer() *server {
 	s := &server{
 		services: make(map[string]ServiceConfig),
-		qpsChan: make([]chan int, 2),  // qps限制
+		limiter: ratelimit.NewLimiters(serverConf.Conf.LimitQPS, serverConf.Conf.RateLimit.Methods, serverConf.Conf.RateLimit.Callers),  // qps限制
+		adaptive: newAdaptiveLimiter(serverConf.Conf.RateLimit.Adaptive),
+		clusterWatched: make(map[string]bool),
+		done: make(chan struct{}),
+		forceStop: make(chan struct{}),
+		stopped: make(chan struct{}),
+		health: health.NewServer(),
+	}
+	// readiness check 通过之前整体状态为 NOT_SERVING
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	s.limiter.UpdateCluster(serverConf.Conf.RateLimit.Cluster)
+	if err := serverConf.Err(); err != nil {
+		s.setErr(err)
+	}
+	if serverConf.Conf.TLS.CertFile != "" {
+		r, err := tlsutil.NewReloader(serverConf.Conf.TLS)
+		if err != nil {
+			s.setErr(fmt.Errorf("NewServer() load tls certificate failed, error: %v", err))
+		}
+		s.tls = r
 	}
 	if serverConf.Conf.RegisterAddr != "" {
-		s.register = registry.Register(serverConf.Conf.RegisterAddr)
-		if s.register == nil {
-			logrus.Fatalln("NewServer() initial register failed")
+		r, err := registry.New(serverConf.Conf.RegisterAddr)
+		if err != nil {
+			s.setErr(fmt.Errorf("NewServer() initial register failed, error: %v", err))
 		}
+		s.register = r
 	}
 	return s
 }
 
+// NewServerE 与 NewServer 相同，有错误时立即返回
+func NewServerE() (*server, error) {
+	s := NewServer()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s, nil
+}
+
+// setErr 记录第一个错误
+func (s *server) setErr(err error) {
+	logrus.Errorln(err)
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Register 添加服务，参数错误时不退出进程，错误在 Start 时返回，需要立即处理错误时使用 RegisterE
 func (s *server) Register(service ServiceConfig) *server {
+	if err := s.RegisterE(service); err != nil {
+		s.setErr(err)
+	}
+	return s
+}
+
+// protoService 向临时的 grpc server 注册服务，返回 .proto 中的服务名和所有方法的完整方法名，RegisterService 和 Server 类型不匹配时返回错误
+// Name 是注册中心中的服务名，可以与 .proto 中的服务名不同，按服务生效的 interceptor 和限流使用 .proto 中的服务名匹配请求
+func protoService(service ServiceConfig) (name string, methods []string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("service[%s] ServiceConfig.RegisterService can't register ServiceConfig.Server, error: %v", service.Name, p)
+		}
+	}()
+	tmp := grpc.NewServer()
+	reflect.ValueOf(service.RegisterService).Call([]reflect.Value{
+		reflect.ValueOf(tmp),
+		reflect.ValueOf(service.Server),
+	})
+	for name, info := range tmp.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods = append(methods, "/"+name+"/"+method.Name)
+		}
+		return name, methods, nil
+	}
+	return "", nil, fmt.Errorf("service[%s] ServiceConfig.RegisterService registered nothing", service.Name)
+}
+
+// RegisterE 与 Register 相同，参数错误时返回错误
+func (s *server) RegisterE(service ServiceConfig) error {
 	if service.Name == "" {
-		logrus.Fatalln("ServiceConfig.Name can't be empty")
+		return errors.New("ServiceConfig.Name can't be empty")
 	}
 	if reflect.ValueOf(service.RegisterService).Kind() != reflect.Func {
-		logrus.Fatalln("ServiceConfig.Register must be a function")
+		return fmt.Errorf("service[%s] ServiceConfig.RegisterService must be a function", service.Name)
 	}
 	if reflect.ValueOf(service.Server).Kind() == reflect.Invalid {
-		logrus.Fatalln("ServiceConfig.Server  invalid")
+		return fmt.Errorf("service[%s] ServiceConfig.Server invalid", service.Name)
 	}
+	protoName, methods, err := protoService(service)
+	if err != nil {
+		return err
+	}
+	service.protoName, service.methods = protoName, methods
 
 	if !service.NoRegistration && s.register == nil {
-		logrus.Fatalln("want register service to registration center, must specify the address in config file")
+		return fmt.Errorf("service[%s] want register service to registration center, must specify the address in config file", service.Name)
+	}
+	if service.Group == "" {
+		service.Group = config.Default.Group
 	}
 	service.metaInner = config.DefaultMetaDataInner
 	service.metaInner.Owner = serverConf.Conf.Owner
+	if s.tls != nil {
+		service.metaInner.TLS = config.MetaTLS
+	}
 	if weight := os.Getenv(config.EnvServerWeight); weight != "" {
 		w, err := strconv.Atoi(weight)
 		if err != nil || w <= 0 {
@@ -75,36 +190,49 @@ func (s *server) Register(service ServiceConfig) *server {
 			service.metaInner.Weight = w
 		}
 	}
+	s.mu.Lock()
 	s.services[service.Name] = service
-	return s
+	s.mu.Unlock()
+	return nil
 }
 
-func (s *server) Start(port int) {
+// Start 开始接收请求，readiness check 通过之后注册到注册中心，阻塞直到 Shutdown
+// 启动失败（监听端口失败、readiness check 超时或者注册失败）时从注册中心删除已经注册的服务并返回错误
+func (s *server) Start(port int) error {
+	if s.err != nil {
+		return s.err
+	}
 	if serverConf.Conf.Zk.Servers != "" {
 		defer s.register.Close()
 	}
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	lis, inherited, err := s.listen(port)
 	if nil != err {
-		logrus.Fatalln(err)
+		logrus.Errorln("listen failed, error:", err)
+		return err
 	}
+	s.listener = lis
 
-	s.port = port
-	if 0 == s.port {
-		addr := lis.Addr().String()
-		items := strings.Split(addr, ":")
-		if len(items) < 2 {
-			logrus.Fatalf("use random port, but get real port failed. addr:[%s]", lis.Addr().String())
-		}
-		if p, err := strconv.Atoi(items[len(items)-1]); err != nil {
-			logrus.Fatalf("use random port, but get real port failed. %s", err)
-		} else {
-			s.port = p
-			logrus.Infof("server will use random port %d", s.port)
-		}
+	// 使用随机端口或者继承的 socket 时从监听地址中获取实际的端口
+	s.port = lis.Addr().(*net.TCPAddr).Port
+	if 0 == port && !inherited {
+		logrus.Infof("server will use random port %d", s.port)
 	}
+	logrus.Infof("listen at %s, advertise %s", lis.Addr(), net.JoinHostPort(config.Default.LocalIP, strconv.Itoa(s.port)))
 
-	s.server = grpc.NewServer()
+	s.server = grpc.NewServer(append(s.serverOptions(),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(s.unaryInterceptors()...)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(s.streamInterceptors()...)),
+	)...)
 	reflection.Register(s.server)
+	// consul 等注册中心和客户端通过 grpc health check 判断实例是否可用
+	healthpb.RegisterHealthServer(s.server, s.health)
+	s.mu.Lock()
+	// 集群限流的 key 为服务名，请求的 FullMethod 中为 .proto 中的服务名
+	protoNames := make(map[string]string, len(s.services))
+	for _, service := range s.services {
+		protoNames[service.protoName] = service.Name
+	}
+	s.limiter.SetServices(protoNames)
 	for _, service := range s.services {
 		f := reflect.ValueOf(service.RegisterService)
 		in := []reflect.Value{
@@ -112,44 +240,65 @@ func (s *server) Start(port int) {
 			reflect.ValueOf(service.Server),
 		}
 		f.Call(in)
+		s.updateHealth(service.Name)
 	}
+	s.mu.Unlock()
 
 	go s.handleSignal()
+	s.startAdmin(serverConf.Conf.AdminAddr)
+	s.checkMethodLimits(serverConf.Conf.RateLimit.Methods)
+	s.watchCluster(serverConf.Conf.RateLimit.Cluster)
 
 	err = s.serveAndRegister(lis)
+	// GracefulStop 关闭监听之后 Serve 立即返回，等待 Shutdown 的 drain 和 hook 执行完成
+	select {
+	case <-s.done:
+		<-s.stopped
+	default:
+	}
 
 	if err == nil || strings.Contains(err.Error(), "use of closed network connection") {
 		logrus.Infoln("owsf server shutdown success")
-	} else {
-		logrus.Errorln("Serve failed, error:", err)
+		return nil
 	}
+	logrus.Errorln("Serve failed, error:", err)
+	return err
 }
 
+// serveAndRegister grpc.Server 开始接收连接并且 readiness check 通过之后注册到注册中心，
+// 启动失败时调用 Shutdown 删除已经注册的服务并返回错误
 func (s *server) serveAndRegister(lis net.Listener) error {
-	var err error
+	l := &acceptListener{
+		Listener:  lis,
+		accepting: make(chan struct{}),
+	}
+	serveErr := make(chan error, 1)
+	logrus.Infoln("starting serve request at port", s.port)
 	go func() {
-		time.Sleep(time.Second)
-		if nil == err {
-			for _, service := range s.services {
-				if !service.NoRegistration {
-					if nil == s.register {
-						logrus.Fatalln("register is nil, this situation should not happen")
-					}
-					if err := s.register.RegisterService(service.Name, s.port, service.metaInner); err != nil {
-						logrus.Warnf("register service [%s] to registration center failed, error: %v", service.Name, err)
-					}
-				}
-			}
-		}
+		serveErr <- s.server.Serve(l)
 	}()
-	logrus.Infoln("starting serve request at port", s.port)
-	err = s.server.Serve(lis)
-	return err
+
+	err := s.waitReady(l, serveErr)
+	if err == nil {
+		err = s.setReady()
+	}
+	s.notifyUpgradeParent(err == nil)
+	switch {
+	case err == errShutdownBeforeReady:
+		return <-serveErr
+	case err != nil:
+		logrus.Errorf("server start failed, error: %v", err)
+		s.Shutdown()
+		<-serveErr
+		return err
+	}
+	logrus.Infoln("server is ready, all services registered")
+	return <-serveErr
 }
 
 func (s *server) handleSignal() {
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGTERM)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM)
 	for c := range sigChan {
 		switch c {
 		case syscall.SIGINT, syscall.SIGTERM:
@@ -157,53 +306,87 @@ func (s *server) handleSignal() {
 			return
 		case syscall.SIGUSR1:
 			s.reloadConfig()
+		case syscall.SIGUSR2:
+			if err := s.upgrade(); err != nil {
+				logrus.Errorf("upgrade failed, error: %v", err)
+			}
 		}
 	}
 }
 
 func (s *server) reloadConfig() {
-	newConfig := serverConf.GetConfFromFile()
-	s.qpsChan[0] <- newConfig.LimitQPS
-	s.qpsChan[1] <- newConfig.LimitQPS
+	newConfig, err := serverConf.GetConfFromFile()
+	if err != nil {
+		logrus.Errorf("reload config failed, keep the current config, error: %v", err)
+		return
+	}
+	s.limiter.Update(newConfig.LimitQPS, newConfig.RateLimit.Methods, newConfig.RateLimit.Callers)
+	s.limiter.UpdateCluster(newConfig.RateLimit.Cluster)
+	adaptive := newConfig.RateLimit.Adaptive
+	s.adaptive.Update(adaptive.Enable, adaptive.InitLimit, adaptive.MinLimit, adaptive.MaxLimit)
+	s.checkMethodLimits(newConfig.RateLimit.Methods)
+	s.watchCluster(newConfig.RateLimit.Cluster)
+	logrus.Infof("reload config success, limitQPS: %d, method limits: %v, caller limits: %v, cluster limits: %v, adaptive limit: %+v",
+		newConfig.LimitQPS, newConfig.RateLimit.Methods, newConfig.RateLimit.Callers, newConfig.RateLimit.Cluster, adaptive)
 }
 
-func (s *server) Shutdown() {
-	logrus.Infoln("shut down owsf server!!!")
-	retry := 3
-
-	unRegistryFailed := false
-	var wg sync.WaitGroup
-	for _, service := range s.services {
-		if !service.NoRegistration {
-			if nil == s.register {
-				logrus.Errorln("register is nil, this situation should not be happen")
-				continue
-			}
-			wg.Add(1)
-			go func(conf ServiceConfig) {
-				defer wg.Done()
-				var err error
-				for n:=1; n<= retry; n++ {
-					if n > 1 {
-						time.Sleep(time.Second * 3)
-					}
-					if err = s.register.UnRegisterService(conf.Name, s.port); err != nil {
-						logrus.Warnf("unregister service[%s] failed(%d), error: %s\n", conf.Name, n, err)
-					} else {
-						break
-					}
-				}
-				if err != nil {
-					unRegistryFailed = true
+// checkMethodLimits 按方法限流的 key 不是任何已注册服务的方法时打印警告，方法名不区分大小写
+func (s *server) checkMethodLimits(methods map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range methods {
+		found := false
+		for _, service := range s.services {
+			for _, method := range service.methods {
+				if strings.EqualFold(key, method) {
+					found = true
 				}
-			}(service)
+			}
+		}
+		if !found {
+			logrus.Warnf("rate limit of method[%s] ignored, no registered method matches, the key must be /proto service name/method name", key)
 		}
 	}
-	wg.Wait()
-	if unRegistryFailed {
-		logrus.Errorln("unregister server info from registration center failed")
+}
+
+func newAdaptiveLimiter(conf serverConf.AdaptiveLimitConfig) *ratelimit.AdaptiveLimiter {
+	return ratelimit.NewAdaptiveLimiter(conf.Enable, conf.InitLimit, conf.MinLimit, conf.MaxLimit)
+}
+
+// registerService 将服务当前的 metadata 注册到注册中心，已经注册时覆盖注册中心中的值，调用时必须持有 s.mu
+func (s *server) registerService(name string) error {
+	service, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("service[%s] not found", name)
+	}
+	if service.NoRegistration || s.register == nil {
+		return fmt.Errorf("service[%s] is not registered to registration center", name)
+	}
+	if err := s.register.RegisterService(service.Name, s.port, service.metaInner, service.Group); err != nil {
+		return err
+	}
+	service.registered = true
+	s.services[name] = service
+	s.updateHealth(name)
+	return nil
+}
+
+// unregisterService 将服务从注册中心删除，调用时必须持有 s.mu
+func (s *server) unregisterService(name string) error {
+	service, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("service[%s] not found", name)
+	}
+	if !service.registered {
+		return nil
+	}
+	if err := s.register.UnRegisterService(service.Name, s.port, service.Group); err != nil {
+		return err
 	}
-	s.server.GracefulStop()
+	service.registered = false
+	s.services[name] = service
+	s.updateHealth(name)
+	return nil
 }
 
 //func initServer() (client *zk.Client) {
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"openWebSF/config/serverConf"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDrainPeriod     = 3000
+	DefaultShutdownTimeout = 10000
+	// 从注册中心删除失败时的重试次数和间隔
+	unregisterRetry         = 3
+	unregisterRetryInterval = 3 * time.Second
+)
+
+// ShutdownHook Shutdown 时 grpc server 停止之后执行，用于关闭数据库连接、刷新缓存等，ctx 的超时时间为 shutdown.timeout
+type ShutdownHook func(ctx context.Context) error
+
+// AddShutdownHook 添加 Shutdown 时执行的 hook，按添加顺序的逆序执行（与 defer 相同）
+func (s *server) AddShutdownHook(hook ...ShutdownHook) *server {
+	s.shutdownHooks = append(s.shutdownHooks, hook...)
+	return s
+}
+
+// Shutdown 优雅退出，SIGINT/SIGTERM、管理接口的 /shutdown 和直接调用都执行相同的流程：
+//  1. health 状态设置为 NOT_SERVING，客户端的 health check 立即停止向本实例发送请求
+//  2. 从注册中心删除
+//  3. 等待 shutdown.drainPeriod（单位 ms，默认 3000），客户端的 watcher 感知到实例下线
+//  4. GracefulStop，等待正在处理的请求完成，超过 shutdown.timeout（单位 ms，默认 10000）之后取消正在处理的 stream 的 context 并强制 Stop
+//  5. 执行 AddShutdownHook 添加的 hook
+//
+// 监听 socket 已经交给新进程（SIGUSR2）时跳过 1 到 3，新进程已经使用相同的地址注册。
+// 多次调用时只执行一次，之后的调用等待第一次调用完成之后返回
+func (s *server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		logrus.Infoln("shut down owsf server!!!")
+		s.doneOnce.Do(func() {
+			close(s.done)
+		})
+		s.mu.Lock()
+		handoff := s.handoff
+		s.mu.Unlock()
+		if handoff {
+			// 新进程已经使用相同的地址注册，客户端收到 GOAWAY 之后重新连接到新进程
+			logrus.Infoln("listener handed off to new process, skip unregister and drain")
+		} else {
+			s.drain()
+		}
+
+		timeout := shutdownDuration(serverConf.Conf.Shutdown.Timeout, DefaultShutdownTimeout)
+		s.stopServer(timeout)
+		s.runShutdownHooks(timeout)
+		s.stopAdmin()
+		if s.tls != nil {
+			s.tls.Close()
+		}
+		close(s.stopped)
+		logrus.Infoln("owsf server shutdown complete")
+	})
+}
+
+// drain health 状态设置为 NOT_SERVING，从注册中心删除并等待客户端感知
+func (s *server) drain() {
+	s.health.Shutdown()
+	registered := s.unregisterAll()
+
+	// 没有注册成功的服务时客户端不会访问本实例，不需要等待
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	if ready || registered {
+		drain := shutdownDuration(serverConf.Conf.Shutdown.DrainPeriod, DefaultDrainPeriod)
+		logrus.Infof("waiting %s for clients to drain", drain)
+		time.Sleep(drain)
+	}
+}
+
+// unregisterAll 从注册中心删除所有已经注册的服务，返回是否有已经注册的服务
+func (s *server) unregisterAll() bool {
+	s.mu.Lock()
+	services := make([]ServiceConfig, 0, len(s.services))
+	for _, service := range s.services {
+		if !service.NoRegistration && service.registered {
+			services = append(services, service)
+		}
+	}
+	s.mu.Unlock()
+
+	// 每个服务的 goroutine 最多写入一个错误，缓冲区足够时不会阻塞
+	errs := make(chan string, len(services))
+	var wg sync.WaitGroup
+	for _, service := range services {
+		wg.Add(1)
+		go func(conf ServiceConfig) {
+			defer wg.Done()
+			var err error
+			for n := 1; n <= unregisterRetry; n++ {
+				if n > 1 {
+					time.Sleep(unregisterRetryInterval)
+				}
+				s.mu.Lock()
+				err = s.unregisterService(conf.Name)
+				s.mu.Unlock()
+				if err == nil {
+					break
+				}
+				logrus.Warnf("unregister service[%s] failed(%d), error: %s", conf.Name, n, err)
+			}
+			if err != nil {
+				errs <- conf.Name
+			}
+		}(service)
+	}
+	wg.Wait()
+	close(errs)
+	failed := make([]string, 0, len(services))
+	for name := range errs {
+		failed = append(failed, name)
+	}
+	if len(failed) > 0 {
+		logrus.Errorf("unregister server info of %v from registration center failed", failed)
+	}
+	return len(services) > 0
+}
+
+// stopServer GracefulStop 超过 timeout 之后取消正在处理的 stream 的 context 并强制 Stop
+func (s *server) stopServer(timeout time.Duration) {
+	if s.server == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return
+	case <-time.After(timeout):
+	}
+	logrus.Warnf("graceful stop not finished after %s, force stop", timeout)
+	close(s.forceStop)
+	s.server.Stop()
+	<-stopped
+}
+
+// runShutdownHooks 按添加顺序的逆序执行 hook，失败时只记录日志
+func (s *server) runShutdownHooks(timeout time.Duration) {
+	if len(s.shutdownHooks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for i := len(s.shutdownHooks) - 1; i >= 0; i-- {
+		if err := s.shutdownHooks[i](ctx); err != nil {
+			logrus.Errorf("shutdown hook %d failed, error: %v", i, err)
+		}
+	}
+}
+
+// streamContext 强制 Stop 时取消正在处理的 stream 的 context，handler 通过 ss.Context() 感知退出
+func (s *server) streamContext(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.forceStop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	wrapped := grpc_middleware.WrapServerStream(ss)
+	wrapped.WrappedContext = ctx
+	return handler(srv, wrapped)
+}
+
+func shutdownDuration(ms int, def int) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Duration(def) * time.Millisecond
+}
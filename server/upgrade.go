@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"openWebSF/config/serverConf"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 新进程继承的监听 socket 和通知旧进程已经 ready 的 pipe 的 fd，ExtraFiles 的 fd 从 3 开始
+	envListenFd = "OWSF_LISTEN_FD"
+	envReadyFd  = "OWSF_READY_FD"
+)
+
+// listen 从旧进程继承了监听 socket 时使用该 socket，否则监听 port，返回是否为继承的 socket
+func (s *server) listen(port int) (net.Listener, bool, error) {
+	fd := os.Getenv(envListenFd)
+	if fd == "" {
+		lis, err := net.Listen("tcp", net.JoinHostPort(serverConf.Conf.Bind, strconv.Itoa(port)))
+		return lis, false, err
+	}
+	// 新进程再次升级时不能继承这些环境变量
+	os.Unsetenv(envListenFd)
+	defer os.Unsetenv(envReadyFd)
+
+	lis, err := inheritListener(fd)
+	if err != nil {
+		return nil, false, err
+	}
+	if fd := os.Getenv(envReadyFd); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			lis.Close()
+			return nil, false, fmt.Errorf("%s[%s] invalid", envReadyFd, fd)
+		}
+		s.upgradeReady = os.NewFile(uintptr(n), "owsf-ready")
+	}
+	s.inherited = true
+	logrus.Infof("inherit listener %s from parent process %d", lis.Addr(), os.Getppid())
+	return lis, true, nil
+}
+
+func inheritListener(fd string) (net.Listener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s[%s] invalid", envListenFd, fd)
+	}
+	f := os.NewFile(uintptr(n), "owsf-listener")
+	defer f.Close()
+	// net.FileListener 复制了 fd，f 可以关闭
+	return net.FileListener(f)
+}
+
+// notifyUpgradeParent 新进程 ready 之后通知旧进程退出，启动失败时只关闭 pipe，旧进程继续服务
+func (s *server) notifyUpgradeParent(ready bool) {
+	if s.upgradeReady == nil {
+		return
+	}
+	if ready {
+		if _, err := s.upgradeReady.Write([]byte{1}); err != nil {
+			logrus.Errorf("notify parent process ready failed, error: %v", err)
+		}
+	}
+	s.upgradeReady.Close()
+	s.upgradeReady = nil
+}
+
+// upgrade 收到 SIGUSR2 时启动新的二进制（os.Executable，参数和环境变量与当前进程相同）并将监听 socket 传给新进程，
+// 新进程注册到注册中心之后当前进程执行 Shutdown 退出，此时新进程已经使用相同的地址注册，因此不从注册中心删除，也不等待 drainPeriod，
+// 新进程启动失败时当前进程重新注册并继续服务
+func (s *server) upgrade() error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("server is shutting down")
+	default:
+	}
+	s.mu.Lock()
+	if s.upgrading {
+		s.mu.Unlock()
+		return fmt.Errorf("upgrade already in progress")
+	}
+	s.upgrading = true
+	s.mu.Unlock()
+
+	err := s.startChild()
+	if err != nil {
+		s.mu.Lock()
+		s.upgrading = false
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *server) startChild() error {
+	tcpLis, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener %T can not be handed off", s.listener)
+	}
+	lisFile, err := tcpLis.File()
+	if err != nil {
+		return err
+	}
+	defer lisFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyW.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		readyR.Close()
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lisFile, readyW}
+	cmd.Env = append(upgradeEnv(os.Environ()), envListenFd+"=3", envReadyFd+"=4")
+	if err := cmd.Start(); err != nil {
+		readyR.Close()
+		return err
+	}
+	logrus.Infof("start new process %d for upgrade", cmd.Process.Pid)
+
+	go func() {
+		// 旧进程退出之前回收新进程启动失败时的僵尸进程，新进程正常运行时旧进程退出之后由 init 接管
+		if err := cmd.Wait(); err != nil {
+			logrus.Warnf("new process %d exited, error: %v", cmd.Process.Pid, err)
+		}
+	}()
+	go s.waitChild(cmd.Process.Pid, readyR)
+	return nil
+}
+
+// waitChild 新进程 ready 之后写入一个字节，启动失败或者退出时 pipe 被关闭
+func (s *server) waitChild(pid int, readyR *os.File) {
+	defer readyR.Close()
+	buf := make([]byte, 1)
+	if n, _ := readyR.Read(buf); n == 1 {
+		logrus.Infof("new process %d is ready, shutdown old process", pid)
+		s.mu.Lock()
+		s.handoff = true
+		s.mu.Unlock()
+		s.Shutdown()
+		return
+	}
+
+	logrus.Errorf("new process %d start failed, old process continue serving", pid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upgrading = false
+	// 新进程使用相同的地址注册时可能已经覆盖或者删除了当前进程的注册信息
+	for _, service := range s.services {
+		if service.registered {
+			if err := s.registerService(service.Name); err != nil {
+				logrus.Errorf("re-register service [%s] failed, error: %v", service.Name, err)
+			}
+		}
+	}
+}
+
+func upgradeEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, e := range env {
+		if strings.HasPrefix(e, envListenFd+"=") || strings.HasPrefix(e, envReadyFd+"=") {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
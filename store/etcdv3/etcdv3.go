@@ -0,0 +1,497 @@
+package etcdv3
+
+import (
+	"context"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+
+	// etcd 的 lease 过期时间，key 在 keep-alive 停止之后最多保留这么久
+	defaultLeaseTTL = 10
+	// keep-alive 失败之后重新申请 lease 的间隔
+	retryInterval = 3 * time.Second
+)
+
+const ETCDV3 = "etcdv3"
+
+// EtcdV3 is the receiver type for
+// the Store interface
+type EtcdV3 struct {
+	timeout time.Duration
+	client  *clientv3.Client
+
+	mu         sync.Mutex
+	lease      clientv3.LeaseID
+	ephemerals map[string]ephemeral
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type ephemeral struct {
+	value []byte
+}
+
+func Register() {
+	libkv.AddStore(ETCDV3, New)
+}
+
+// New creates a new etcd v3 client given a
+// list of endpoints and an optional tls config
+func New(endpoints []string, options *store.Config) (store.Store, error) {
+	s := &EtcdV3{
+		timeout:    defaultTimeout,
+		ephemerals: make(map[string]ephemeral),
+		done:       make(chan struct{}),
+	}
+
+	cfg := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: defaultTimeout,
+	}
+	if options != nil {
+		if options.ConnectionTimeout != 0 {
+			s.timeout = options.ConnectionTimeout
+			cfg.DialTimeout = options.ConnectionTimeout
+		}
+		cfg.TLS = options.TLS
+		cfg.Username = options.Username
+		cfg.Password = options.Password
+	}
+
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+// Get the value at "key", returns the last modified index
+// to use in conjunction to Atomic calls
+func (s *EtcdV3) Get(key string) (*store.KVPair, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Get(ctx, normalize(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return &store.KVPair{
+		Key:       key,
+		Value:     resp.Kvs[0].Value,
+		LastIndex: uint64(resp.Kvs[0].ModRevision),
+	}, nil
+}
+
+// Put a value at "key", a key written with a TTL is attached to the
+// lease of this store like a zookeeper ephemeral node, the lease is
+// kept alive until the store is closed
+func (s *EtcdV3) Put(key string, value []byte, opts *store.WriteOptions) error {
+	fkey := normalize(key)
+	if opts == nil || opts.TTL <= 0 {
+		ctx, cancel := s.context()
+		defer cancel()
+		_, err := s.client.Put(ctx, fkey, string(value))
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, err := s.getLease()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if _, err := s.client.Put(ctx, fkey, string(value), clientv3.WithLease(lease)); err != nil {
+		return err
+	}
+	s.ephemerals[fkey] = ephemeral{value: value}
+	return nil
+}
+
+// Delete a value at "key"
+func (s *EtcdV3) Delete(key string) error {
+	fkey := normalize(key)
+	s.mu.Lock()
+	delete(s.ephemerals, fkey)
+	s.mu.Unlock()
+
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Delete(ctx, fkey)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return store.ErrKeyNotFound
+	}
+	return nil
+}
+
+// Exists checks if the key exists inside the store
+func (s *EtcdV3) Exists(key string) (bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Get(ctx, normalize(key), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// Watch for changes on a "key"
+// It returns a channel that will receive changes or pass
+// on errors. Upon creation, the current value will first
+// be sent to the channel. Providing a non-nil stopCh can
+// be used to stop watching.
+func (s *EtcdV3) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	pair, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan *store.KVPair)
+	go func() {
+		defer close(watchCh)
+		ctx, cancel := s.watchContext(stopCh)
+		defer cancel()
+
+		select {
+		case watchCh <- pair:
+		case <-ctx.Done():
+			return
+		}
+		events := s.client.Watch(ctx, normalize(key), clientv3.WithRev(int64(pair.LastIndex)+1))
+		for resp := range events {
+			if err := resp.Err(); err != nil {
+				logrus.Warnf("etcd watch key[%s] failed, error: %v", key, err)
+				return
+			}
+			for _, e := range resp.Events {
+				if e.Kv == nil || e.Type != clientv3.EventTypePut {
+					continue
+				}
+				select {
+				case watchCh <- &store.KVPair{
+					Key:       key,
+					Value:     e.Kv.Value,
+					LastIndex: uint64(e.Kv.ModRevision),
+				}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on a "directory"
+// It returns a channel that will receive changes or pass
+// on errors. Upon creating a watch, the current childs values
+// will be sent to the channel .Providing a non-nil stopCh can
+// be used to stop watching.
+func (s *EtcdV3) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	entries, rev, err := s.list(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan []*store.KVPair)
+	go func() {
+		defer close(watchCh)
+		ctx, cancel := s.watchContext(stopCh)
+		defer cancel()
+
+		for {
+			select {
+			case watchCh <- entries:
+			case <-ctx.Done():
+				return
+			}
+
+			// etcd 的 watch 可能因为 compact 等原因被取消，此时重新 list 并从最新的 revision 开始 watch
+			events := s.client.Watch(ctx, prefix(directory), clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+			for resp := range events {
+				if err := resp.Err(); err != nil {
+					logrus.Warnf("etcd watch directory[%s] failed, error: %v", directory, err)
+					break
+				}
+				if len(resp.Events) == 0 {
+					continue
+				}
+				if entries, rev, err = s.list(directory); err != nil {
+					logrus.Warnf("etcd list directory[%s] failed, error: %v", directory, err)
+					continue
+				}
+				select {
+				case watchCh <- entries:
+				case <-ctx.Done():
+					return
+				}
+			}
+			// ctx 在 stopCh 关闭或者 store Close 时取消，等待重试期间也能立即退出
+			select {
+			case <-time.After(retryInterval):
+			case <-stopCh:
+				return
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if entries, rev, err = s.list(directory); err != nil {
+				logrus.Warnf("etcd list directory[%s] failed, error: %v", directory, err)
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// List child nodes of a given directory, etcd has no directories
+// so an empty directory is returned as an empty list
+func (s *EtcdV3) List(directory string) ([]*store.KVPair, error) {
+	kv, _, err := s.list(directory)
+	return kv, err
+}
+
+// list returns the direct children of directory like zookeeper
+// and the revision of the etcd cluster when listing
+func (s *EtcdV3) list(directory string) ([]*store.KVPair, int64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	dir := prefix(directory)
+	resp, err := s.client.Get(ctx, dir, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kv := []*store.KVPair{}
+	for _, item := range resp.Kvs {
+		name := strings.TrimPrefix(string(item.Key), dir)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		kv = append(kv, &store.KVPair{
+			Key:       name,
+			Value:     item.Value,
+			LastIndex: uint64(item.ModRevision),
+		})
+	}
+	return kv, resp.Header.Revision, nil
+}
+
+// DeleteTree deletes a range of keys under a given directory
+func (s *EtcdV3) DeleteTree(directory string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err := s.client.Delete(ctx, prefix(directory), clientv3.WithPrefix())
+	return err
+}
+
+// AtomicPut put a value at "key" if the key has not been
+// modified in the meantime, throws an error if this is the case
+func (s *EtcdV3) AtomicPut(key string, value []byte, previous *store.KVPair, _ *store.WriteOptions) (bool, *store.KVPair, error) {
+	fkey := normalize(key)
+	var cmp clientv3.Cmp
+	if previous != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(fkey), "=", int64(previous.LastIndex))
+	} else {
+		// Interpret previous == nil as create operation.
+		cmp = clientv3.Compare(clientv3.CreateRevision(fkey), "=", 0)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(fkey, string(value))).Commit()
+	if err != nil {
+		return false, nil, err
+	}
+	if !resp.Succeeded {
+		if previous == nil {
+			return false, nil, store.ErrKeyExists
+		}
+		return false, nil, store.ErrKeyModified
+	}
+
+	pair := &store.KVPair{
+		Key:       key,
+		Value:     value,
+		LastIndex: uint64(resp.Header.Revision),
+	}
+	return true, pair, nil
+}
+
+// AtomicDelete deletes a value at "key" if the key
+// has not been modified in the meantime, throws an
+// error if this is the case
+func (s *EtcdV3) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	fkey := normalize(key)
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(fkey), "=", int64(previous.LastIndex))).
+		Then(clientv3.OpDelete(fkey)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !resp.Succeeded {
+		if exists, err := s.Exists(key); err == nil && !exists {
+			return false, store.ErrKeyNotFound
+		}
+		return false, store.ErrKeyModified
+	}
+	return true, nil
+}
+
+// NewLock is not supported by the etcd v3 store
+func (s *EtcdV3) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// Close revokes the lease so the ephemeral keys are removed
+// immediately and closes the client connection
+func (s *EtcdV3) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		if s.lease != clientv3.NoLease {
+			ctx, cancel := s.context()
+			if _, err := s.client.Revoke(ctx, s.lease); err != nil {
+				logrus.Warnf("etcd revoke lease[%x] failed, error: %v", s.lease, err)
+			}
+			cancel()
+			s.lease = clientv3.NoLease
+		}
+		s.mu.Unlock()
+		s.client.Close()
+	})
+}
+
+// getLease returns the lease of this store, a new lease is granted
+// and kept alive if there is none. Must be called with s.mu held
+func (s *EtcdV3) getLease() (clientv3.LeaseID, error) {
+	if s.lease != clientv3.NoLease {
+		return s.lease, nil
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Grant(ctx, defaultLeaseTTL)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	// keep-alive 的 context 在 store Close 时取消
+	kaCtx, kaCancel := s.watchContext(nil)
+	ch, err := s.client.KeepAlive(kaCtx, resp.ID)
+	if err != nil {
+		kaCancel()
+		return clientv3.NoLease, err
+	}
+	s.lease = resp.ID
+	go s.keepAlive(resp.ID, ch, kaCancel)
+	return s.lease, nil
+}
+
+// keepAlive consumes the keep-alive responses, when the lease is lost
+// (e.g. the connection to etcd was broken for longer than the TTL)
+// a new lease is granted and all the ephemeral keys are put again
+func (s *EtcdV3) keepAlive(id clientv3.LeaseID, ch <-chan *clientv3.LeaseKeepAliveResponse, cancel context.CancelFunc) {
+	defer cancel()
+	for range ch {
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		logrus.Warnf("etcd lease[%x] keep-alive stopped, grant a new lease", id)
+
+		s.mu.Lock()
+		if s.lease == id {
+			s.lease = clientv3.NoLease
+		}
+		err := s.putEphemerals()
+		s.mu.Unlock()
+		if err == nil {
+			return
+		}
+		logrus.Errorf("etcd retry put ephemeral keys failed, error: %v", err)
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// putEphemerals puts all the ephemeral keys with a new lease. Must be called with s.mu held
+func (s *EtcdV3) putEphemerals() error {
+	if len(s.ephemerals) == 0 {
+		return nil
+	}
+	lease, err := s.getLease()
+	if err != nil {
+		return err
+	}
+	for key, e := range s.ephemerals {
+		ctx, cancel := s.context()
+		_, err := s.client.Put(ctx, key, string(e.value), clientv3.WithLease(lease))
+		cancel()
+		if err != nil {
+			return err
+		}
+		logrus.Infof("etcd retry put key[%s] success", key)
+	}
+	return nil
+}
+
+func (s *EtcdV3) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// watchContext returns a context which is cancelled when
+// stopCh is closed or the store is closed
+func (s *EtcdV3) watchContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+		case <-s.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// Normalize the key for usage in etcd
+func normalize(key string) string {
+	key = store.Normalize(key)
+	return strings.TrimSuffix(key, "/")
+}
+
+func prefix(directory string) string {
+	return normalize(directory) + "/"
+}
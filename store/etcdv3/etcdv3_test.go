@@ -0,0 +1,327 @@
+package etcdv3
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/docker/libkv/store"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 每个测试使用不同的端口，避免前一个测试的 etcd 还没有完全退出
+var port int32 = 23790
+
+type testEtcd struct {
+	dir    string
+	client string
+	peer   string
+	etcd   *embed.Etcd
+}
+
+func startEtcd(t *testing.T) *testEtcd {
+	dir, err := ioutil.TempDir("", "etcdv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := atomic.AddInt32(&port, 2)
+	e := &testEtcd{
+		dir:    dir,
+		client: fmt.Sprintf("http://127.0.0.1:%d", p),
+		peer:   fmt.Sprintf("http://127.0.0.1:%d", p+1),
+	}
+	e.start(t)
+	return e
+}
+
+// start 使用相同的数据目录和端口启动，用于模拟 etcd 重启
+func (e *testEtcd) start(t *testing.T) {
+	client, _ := url.Parse(e.client)
+	peer, _ := url.Parse(e.peer)
+	cfg := embed.NewConfig()
+	cfg.Dir = e.dir
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*client}, []url.URL{*client}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peer}, []url.URL{*peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		etcd.Close()
+		t.Fatal("embedded etcd not ready")
+	}
+	e.etcd = etcd
+}
+
+func (e *testEtcd) stop() {
+	e.etcd.Close()
+	<-e.etcd.Err()
+}
+
+func (e *testEtcd) close() {
+	e.etcd.Close()
+	os.RemoveAll(e.dir)
+}
+
+func (e *testEtcd) store(t *testing.T) *EtcdV3 {
+	s, err := New([]string{e.client}, &store.Config{ConnectionTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*EtcdV3)
+}
+
+// eventually 在 timeout 之内等待 cond 返回 true
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+	}
+}
+
+func exists(s *EtcdV3, key string) bool {
+	ok, err := s.Exists(key)
+	return err == nil && ok
+}
+
+func value(s *EtcdV3, key string) string {
+	pair, err := s.Get(key)
+	if err != nil {
+		return ""
+	}
+	return string(pair.Value)
+}
+
+func TestEphemeral(t *testing.T) {
+	e := startEtcd(t)
+	defer e.close()
+	check := e.store(t)
+	defer check.Close()
+
+	tests := []struct {
+		name string
+		// lost 在 owner 写入之后执行，模拟 lease 丢失、store Close 等
+		lost   func(owner *EtcdV3)
+		exists bool
+		value  string
+	}{
+		{
+			name:   "kept alive",
+			exists: true,
+			value:  "v2",
+		},
+		{
+			name:   "revoked on close",
+			lost:   func(owner *EtcdV3) { owner.Close() },
+			exists: false,
+		},
+		{
+			// lease 过期或者被撤销之后 keep-alive 停止，使用新的 lease 重新写入最后一次的值
+			name: "re-put after lease revoked",
+			lost: func(owner *EtcdV3) {
+				owner.mu.Lock()
+				lease := owner.lease
+				owner.mu.Unlock()
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				if _, err := check.client.Revoke(ctx, lease); err != nil {
+					t.Fatal(err)
+				}
+			},
+			exists: true,
+			value:  "v2",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := fmt.Sprintf("ephemeral/%d", i)
+			owner := e.store(t)
+			defer owner.Close()
+			for _, v := range []string{"v1", "v2"} {
+				if err := owner.Put(key, []byte(v), &store.WriteOptions{TTL: time.Second}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.lost != nil {
+				tt.lost(owner)
+			}
+			if !tt.exists {
+				eventually(t, 3*time.Second, func() bool { return !exists(check, key) }, "key %s not removed", key)
+				return
+			}
+			eventually(t, 3*retryInterval, func() bool { return value(check, key) == tt.value },
+				"key %s = %s, want %s", key, value(check, key), tt.value)
+		})
+	}
+}
+
+// TestLeaseExpired keep-alive 停止超过 TTL 之后 lease 过期，重新申请 lease 并写入临时节点
+func TestLeaseExpired(t *testing.T) {
+	e := startEtcd(t)
+	defer e.close()
+	owner := e.store(t)
+	defer owner.Close()
+	check := e.store(t)
+	defer check.Close()
+
+	// 使用很短的 lease 写入之后停止 keep-alive，与连接断开超过 TTL 的效果相同
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resp, err := owner.client.Grant(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kaCtx, kaCancel := context.WithCancel(context.Background())
+	ch, err := owner.client.KeepAlive(kaCtx, resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner.mu.Lock()
+	owner.lease = resp.ID
+	owner.mu.Unlock()
+	go owner.keepAlive(resp.ID, ch, kaCancel)
+	if err := owner.Put("expired/1", []byte("v"), &store.WriteOptions{TTL: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 停止 keep-alive 之后 keepAlive goroutine 立即使用新的 lease 重新写入
+	kaCancel()
+	eventually(t, 3*time.Second, func() bool {
+		owner.mu.Lock()
+		defer owner.mu.Unlock()
+		return owner.lease != resp.ID && owner.lease != clientv3.NoLease
+	}, "lease not renewed")
+	time.Sleep(2 * time.Second)
+	if value(check, "expired/1") != "v" {
+		t.Fatal("ephemeral key lost after the old lease expired")
+	}
+}
+
+// TestWatchTreeRelist watch 因为 compact 失败之后重新 list 并继续 watch
+func TestWatchTreeRelist(t *testing.T) {
+	e := startEtcd(t)
+	defer e.close()
+	s := e.store(t)
+	defer s.Close()
+
+	s.Put("tree/1", []byte("1"), nil)
+	stop := make(chan struct{})
+	defer close(stop)
+	events, err := s.WatchTree("tree", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次的结果还没有读取时 watch 还没有开始，compact 之后 watch 的 revision 已经不存在
+	s.Put("tree/2", []byte("2"), nil)
+	s.Put("tree/3", []byte("3"), nil)
+	pair, _ := s.Get("tree/3")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := s.client.Compact(ctx, int64(pair.LastIndex)); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(want int) {
+		t.Helper()
+		select {
+		case pairs, ok := <-events:
+			if !ok {
+				t.Fatal("WatchTree() closed")
+			}
+			if len(pairs) != want {
+				t.Fatalf("WatchTree() = %d entries, want %d", len(pairs), want)
+			}
+		case <-time.After(3 * retryInterval):
+			t.Fatalf("WatchTree() timeout, want %d entries", want)
+		}
+	}
+	recv(1)
+	recv(3)
+	s.Delete("tree/1")
+	recv(2)
+}
+
+// TestReconnect etcd 重启之后 store 自动重连，watch 继续收到事件，临时节点仍然存在
+func TestReconnect(t *testing.T) {
+	e := startEtcd(t)
+	defer e.close()
+	s := e.store(t)
+	defer s.Close()
+
+	if err := s.Put("reconnect/1", []byte("1"), &store.WriteOptions{TTL: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	events, err := s.WatchTree("reconnect", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-events
+
+	e.stop()
+	time.Sleep(time.Second)
+	e.start(t)
+
+	eventually(t, 10*time.Second, func() bool {
+		return s.Put("reconnect/2", []byte("2"), nil) == nil
+	}, "put after etcd restarted failed")
+	select {
+	case pairs, ok := <-events:
+		if !ok || len(pairs) != 2 {
+			t.Fatalf("WatchTree() = %v, %v, want 2 entries", pairs, ok)
+		}
+	case <-time.After(3 * retryInterval):
+		t.Fatal("WatchTree() no event after etcd restarted")
+	}
+	if value(s, "reconnect/1") != "1" {
+		t.Fatal("ephemeral key lost after etcd restarted")
+	}
+}
+
+// TestWatchTreeCloseDuringRetry watch 失败之后等待重试期间 Close store，watch 立即结束
+func TestWatchTreeCloseDuringRetry(t *testing.T) {
+	e := startEtcd(t)
+	defer e.close()
+	s := e.store(t)
+
+	s.Put("retry/1", []byte("1"), nil)
+	events, err := s.WatchTree("retry", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compact 之后 watch 的 revision 已经不存在，watch 失败并等待重试
+	s.Put("retry/2", []byte("2"), nil)
+	pair, _ := s.Get("retry/2")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := s.client.Compact(ctx, int64(pair.LastIndex)); err != nil {
+		t.Fatal(err)
+	}
+	<-events
+	time.Sleep(500 * time.Millisecond)
+
+	s.Close()
+	timeout := time.After(retryInterval / 2)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("WatchTree() not closed after the store closed")
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package memory
+
+import (
+	"bytes"
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const MEMORY = "memory"
+
+// 同名的 store 共享同一份数据，便于同一进程中的 server 和 client 互相发现
+var trees = struct {
+	sync.Mutex
+	m map[string]*tree
+}{
+	m: make(map[string]*tree),
+}
+
+type entry struct {
+	value []byte
+	index uint64
+	owner *Memory // 不为 nil 时表示临时节点，owner Close 之后删除
+}
+
+type tree struct {
+	sync.RWMutex
+	entries  map[string]*entry
+	dirs     map[string]struct{}
+	index    uint64
+	watchers map[chan struct{}]struct{}
+}
+
+// Memory is the receiver type for
+// the Store interface
+type Memory struct {
+	tree      *tree
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Register() {
+	libkv.AddStore(MEMORY, New)
+}
+
+// New creates a new in-process store, endpoints[0] is used as
+// the name of the data set, stores with the same name share data
+func New(endpoints []string, options *store.Config) (store.Store, error) {
+	name := ""
+	if len(endpoints) > 0 {
+		name = endpoints[0]
+	}
+	return &Memory{
+		tree: getTree(name),
+		done: make(chan struct{}),
+	}, nil
+}
+
+func getTree(name string) *tree {
+	trees.Lock()
+	defer trees.Unlock()
+	t, ok := trees.m[name]
+	if !ok {
+		t = &tree{
+			entries:  make(map[string]*entry),
+			dirs:     make(map[string]struct{}),
+			watchers: make(map[chan struct{}]struct{}),
+		}
+		trees.m[name] = t
+	}
+	return t
+}
+
+// Get the value at "key", returns the last modified index
+// to use in conjunction to Atomic calls
+func (s *Memory) Get(key string) (*store.KVPair, error) {
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	e, ok := s.tree.entries[normalize(key)]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return &store.KVPair{
+		Key:       key,
+		Value:     e.value,
+		LastIndex: e.index,
+	}, nil
+}
+
+// Put a value at "key", a key written with a TTL behaves like a
+// zookeeper ephemeral node: it is removed when the store that
+// wrote it last is closed, the TTL itself never expires
+func (s *Memory) Put(key string, value []byte, opts *store.WriteOptions) error {
+	s.tree.Lock()
+	s.tree.put(normalize(key), value, s.owner(opts))
+	s.tree.Unlock()
+	s.tree.notify()
+	return nil
+}
+
+// Delete a value at "key"
+func (s *Memory) Delete(key string) error {
+	s.tree.Lock()
+	err := s.tree.delete(normalize(key))
+	s.tree.Unlock()
+	if err == nil {
+		s.tree.notify()
+	}
+	return err
+}
+
+// Exists checks if the key exists inside the store
+func (s *Memory) Exists(key string) (bool, error) {
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	_, ok := s.tree.entries[normalize(key)]
+	return ok, nil
+}
+
+// Watch for changes on a "key"
+// It returns a channel that will receive changes or pass
+// on errors. Upon creation, the current value will first
+// be sent to the channel. Providing a non-nil stopCh can
+// be used to stop watching.
+func (s *Memory) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	pair, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	events := s.tree.subscribe()
+	watchCh := make(chan *store.KVPair)
+	go func() {
+		defer close(watchCh)
+		defer s.tree.unsubscribe(events)
+
+		last := pair
+		for {
+			select {
+			case watchCh <- last:
+			case <-stopCh:
+				return
+			case <-s.done:
+				return
+			}
+			for {
+				if !s.wait(events, stopCh) {
+					return
+				}
+				current, err := s.Get(key)
+				if err != nil {
+					// the key has been deleted
+					return
+				}
+				if current.LastIndex != last.LastIndex {
+					last = current
+					break
+				}
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on a "directory"
+// It returns a channel that will receive changes or pass
+// on errors. Upon creating a watch, the current childs values
+// will be sent to the channel .Providing a non-nil stopCh can
+// be used to stop watching.
+func (s *Memory) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	entries, err := s.List(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	events := s.tree.subscribe()
+	watchCh := make(chan []*store.KVPair)
+	go func() {
+		defer close(watchCh)
+		defer s.tree.unsubscribe(events)
+
+		last := entries
+		for {
+			select {
+			case watchCh <- last:
+			case <-stopCh:
+				return
+			case <-s.done:
+				return
+			}
+			for {
+				if !s.wait(events, stopCh) {
+					return
+				}
+				current, err := s.List(directory)
+				if err != nil {
+					// the directory has been deleted
+					return
+				}
+				if !equal(current, last) {
+					last = current
+					break
+				}
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// List child nodes of a given directory, the keys of the
+// returned pairs are the names of the children like zookeeper
+func (s *Memory) List(directory string) ([]*store.KVPair, error) {
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	dir := normalize(directory)
+	if !s.tree.exists(dir) {
+		return nil, store.ErrKeyNotFound
+	}
+
+	kv := []*store.KVPair{}
+	for _, child := range s.tree.children(dir) {
+		pair := &store.KVPair{Key: child}
+		if e, ok := s.tree.entries[dir+"/"+child]; ok {
+			pair.Value = e.value
+			pair.LastIndex = e.index
+		}
+		kv = append(kv, pair)
+	}
+	return kv, nil
+}
+
+// DeleteTree deletes a range of keys under a given directory
+func (s *Memory) DeleteTree(directory string) error {
+	dir := normalize(directory)
+	s.tree.Lock()
+	if !s.tree.exists(dir) {
+		s.tree.Unlock()
+		return store.ErrKeyNotFound
+	}
+	for key := range s.tree.entries {
+		if strings.HasPrefix(key, dir+"/") {
+			delete(s.tree.entries, key)
+		}
+	}
+	for key := range s.tree.dirs {
+		if strings.HasPrefix(key, dir+"/") {
+			delete(s.tree.dirs, key)
+		}
+	}
+	s.tree.Unlock()
+	s.tree.notify()
+	return nil
+}
+
+// AtomicPut put a value at "key" if the key has not been
+// modified in the meantime, throws an error if this is the case
+func (s *Memory) AtomicPut(key string, value []byte, previous *store.KVPair, opts *store.WriteOptions) (bool, *store.KVPair, error) {
+	fkey := normalize(key)
+	s.tree.Lock()
+	e, ok := s.tree.entries[fkey]
+	switch {
+	case previous == nil && ok:
+		s.tree.Unlock()
+		return false, nil, store.ErrKeyExists
+	case previous != nil && !ok:
+		s.tree.Unlock()
+		return false, nil, store.ErrKeyNotFound
+	case previous != nil && e.index != previous.LastIndex:
+		s.tree.Unlock()
+		return false, nil, store.ErrKeyModified
+	}
+	index := s.tree.put(fkey, value, s.owner(opts))
+	s.tree.Unlock()
+	s.tree.notify()
+
+	return true, &store.KVPair{
+		Key:       key,
+		Value:     value,
+		LastIndex: index,
+	}, nil
+}
+
+// AtomicDelete deletes a value at "key" if the key
+// has not been modified in the meantime, throws an
+// error if this is the case
+func (s *Memory) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	fkey := normalize(key)
+	s.tree.Lock()
+	e, ok := s.tree.entries[fkey]
+	if !ok {
+		s.tree.Unlock()
+		return false, store.ErrKeyNotFound
+	}
+	if e.index != previous.LastIndex {
+		s.tree.Unlock()
+		return false, store.ErrKeyModified
+	}
+	err := s.tree.delete(fkey)
+	s.tree.Unlock()
+	if err != nil {
+		return false, err
+	}
+	s.tree.notify()
+	return true, nil
+}
+
+// NewLock is not supported by the memory store
+func (s *Memory) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// Close removes the ephemeral keys written by this
+// store and stops all the watches
+func (s *Memory) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.tree.Lock()
+		for key, e := range s.tree.entries {
+			if e.owner == s {
+				delete(s.tree.entries, key)
+			}
+		}
+		s.tree.Unlock()
+		s.tree.notify()
+	})
+}
+
+func (s *Memory) owner(opts *store.WriteOptions) *Memory {
+	if opts != nil && opts.TTL > 0 {
+		return s
+	}
+	return nil
+}
+
+// wait blocks until the tree changed, returns false if the watch should stop
+func (s *Memory) wait(events chan struct{}, stopCh <-chan struct{}) bool {
+	select {
+	case <-events:
+		return true
+	case <-stopCh:
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+// put must be called with the lock held, the entry belongs to
+// the last writer so that closing a previous owner keeps it
+func (t *tree) put(key string, value []byte, owner *Memory) uint64 {
+	t.index++
+	e, ok := t.entries[key]
+	if !ok {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.value = value
+	e.index = t.index
+	e.owner = owner
+
+	// create the parent directories like zookeeper createFullPath
+	for dir := parent(key); dir != ""; dir = parent(dir) {
+		t.dirs[dir] = struct{}{}
+	}
+	return t.index
+}
+
+// delete must be called with the lock held
+func (t *tree) delete(key string) error {
+	if !t.exists(key) {
+		return store.ErrKeyNotFound
+	}
+	delete(t.entries, key)
+	if len(t.children(key)) == 0 {
+		delete(t.dirs, key)
+	}
+	return nil
+}
+
+func (t *tree) exists(key string) bool {
+	if _, ok := t.entries[key]; ok {
+		return true
+	}
+	_, ok := t.dirs[key]
+	return ok
+}
+
+// children returns the sorted names of the direct children of dir
+func (t *tree) children(dir string) []string {
+	set := make(map[string]struct{})
+	for key := range t.entries {
+		if parent(key) == dir {
+			set[key[len(dir)+1:]] = struct{}{}
+		}
+	}
+	for key := range t.dirs {
+		if parent(key) == dir {
+			set[key[len(dir)+1:]] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *tree) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	t.Lock()
+	t.watchers[ch] = struct{}{}
+	t.Unlock()
+	return ch
+}
+
+func (t *tree) unsubscribe(ch chan struct{}) {
+	t.Lock()
+	delete(t.watchers, ch)
+	t.Unlock()
+}
+
+// notify wakes up all the watches, must be called without the lock held
+func (t *tree) notify() {
+	t.RLock()
+	defer t.RUnlock()
+	for ch := range t.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func equal(a, b []*store.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize the key for usage in the memory store
+func normalize(key string) string {
+	key = store.Normalize(key)
+	return strings.TrimSuffix(key, "/")
+}
+
+func parent(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 {
+		return ""
+	}
+	return key[:i]
+}
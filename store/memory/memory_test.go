@@ -0,0 +1,197 @@
+package memory
+
+import (
+	"github.com/docker/libkv/store"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T, name string) *Memory {
+	s, err := New([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*Memory)
+}
+
+func keys(pairs []*store.KVPair) []string {
+	names := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		names = append(names, pair.Key)
+	}
+	return names
+}
+
+func TestPutGetDelete(t *testing.T) {
+	tests := []struct {
+		name      string
+		put       []string
+		delete    string
+		deleteErr error
+		get       string
+		wantErr   error
+	}{
+		{name: "put", put: []string{"a/b"}, get: "a/b"},
+		{name: "trailing slash", put: []string{"a/b/"}, get: "a/b"},
+		{name: "parent directory", put: []string{"a/b/c"}, get: "a/b", wantErr: store.ErrKeyNotFound},
+		{name: "delete", put: []string{"a/b"}, delete: "a/b", get: "a/b", wantErr: store.ErrKeyNotFound},
+		{name: "delete missing", delete: "a/b", deleteErr: store.ErrKeyNotFound, get: "a/b", wantErr: store.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t, t.Name())
+			defer s.Close()
+			for _, key := range tt.put {
+				if err := s.Put(key, []byte("v"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.delete != "" {
+				if err := s.Delete(tt.delete); err != tt.deleteErr {
+					t.Fatalf("Delete() error = %v, want %v", err, tt.deleteErr)
+				}
+			}
+			pair, err := s.Get(tt.get)
+			if err != tt.wantErr {
+				t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(pair.Value) != "v" {
+				t.Fatalf("Get() value = %s, want v", pair.Value)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name    string
+		put     []string
+		dir     string
+		want    []string
+		wantErr error
+	}{
+		{name: "children", put: []string{"s/g/1", "s/g/2", "s/g/3/x"}, dir: "s/g", want: []string{"1", "2", "3"}},
+		{name: "directories", put: []string{"s/g/1", "s/x"}, dir: "s", want: []string{"g", "x"}},
+		{name: "missing", put: []string{"s/g/1"}, dir: "s/h", wantErr: store.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t, t.Name())
+			defer s.Close()
+			for _, key := range tt.put {
+				s.Put(key, []byte(key), nil)
+			}
+			pairs, err := s.List(tt.dir)
+			if err != tt.wantErr {
+				t.Fatalf("List() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := keys(pairs); err == nil && !equalStrings(got, tt.want) {
+				t.Fatalf("List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEphemeral TTL 只表示临时节点，不会因为超时删除，写入的 store Close 之后删除
+func TestEphemeral(t *testing.T) {
+	tests := []struct {
+		name   string
+		reput  bool // 另一个 store 重新写入同一个 key
+		closed string
+		exists bool
+	}{
+		{name: "ttl does not expire", exists: true},
+		{name: "owner closed", closed: "owner", exists: false},
+		{name: "other closed", closed: "other", exists: true},
+		{name: "reput transfers ownership, old owner closed", reput: true, closed: "owner", exists: true},
+		{name: "reput transfers ownership, new owner closed", reput: true, closed: "other", exists: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, other := newStore(t, t.Name()), newStore(t, t.Name())
+			defer owner.Close()
+			defer other.Close()
+			if err := owner.Put("s/g/1", []byte("v"), &store.WriteOptions{TTL: time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.reput {
+				other.Put("s/g/1", []byte("v2"), &store.WriteOptions{TTL: time.Millisecond})
+			}
+			time.Sleep(10 * time.Millisecond)
+			switch tt.closed {
+			case "owner":
+				owner.Close()
+			case "other":
+				other.Close()
+			}
+			check := newStore(t, t.Name())
+			defer check.Close()
+			if exists, _ := check.Exists("s/g/1"); exists != tt.exists {
+				t.Fatalf("Exists() = %v, want %v", exists, tt.exists)
+			}
+		})
+	}
+}
+
+func TestWatchTree(t *testing.T) {
+	s := newStore(t, t.Name())
+	defer s.Close()
+	s.Put("s/g/1", []byte("1"), nil)
+	stop := make(chan struct{})
+	events, err := s.WatchTree("s/g", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(want ...string) {
+		t.Helper()
+		select {
+		case pairs := <-events:
+			if got := keys(pairs); !equalStrings(got, want) {
+				t.Fatalf("WatchTree() = %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("WatchTree() timeout, want %v", want)
+		}
+	}
+	recv("1")
+
+	ephemeral := newStore(t, t.Name())
+	steps := []struct {
+		name   string
+		action func()
+		want   []string
+	}{
+		{name: "put", action: func() { s.Put("s/g/2", []byte("2"), nil) }, want: []string{"1", "2"}},
+		{name: "modify", action: func() { s.Put("s/g/2", []byte("22"), nil) }, want: []string{"1", "2"}},
+		{name: "delete", action: func() { s.Delete("s/g/1") }, want: []string{"2"}},
+		{name: "ephemeral put", action: func() { ephemeral.Put("s/g/3", []byte("3"), &store.WriteOptions{TTL: time.Second}) }, want: []string{"2", "3"}},
+		{name: "ephemeral owner closed", action: ephemeral.Close, want: []string{"2"}},
+	}
+	for _, step := range steps {
+		step.action()
+		recv(step.want...)
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("WatchTree() not closed after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WatchTree() not closed after stop")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"net"
+	"openWebSF/config"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 检查证书文件是否修改的间隔
+const reloadInterval = 5 * time.Second
+
+// Instances 记录 resolver 解析出的实例是否要求 TLS，key 与 grpc 建立连接使用的地址相同，
+// 每个 target 一份，由该 target 的 resolver 根据实例 metadata 中的 tls 更新
+type Instances struct {
+	mu  sync.RWMutex
+	tls map[string]bool
+}
+
+func NewInstances() *Instances {
+	return &Instances{
+		tls: make(map[string]bool),
+	}
+}
+
+// Update 使用 resolver 最新的地址列表替换之前的记录
+func (i *Instances) Update(tls map[string]bool) {
+	i.mu.Lock()
+	i.tls = tls
+	i.mu.Unlock()
+}
+
+// RequireTLS 返回实例是否要求 TLS，known 为 false 表示 resolver 没有返回该地址
+func (i *Instances) RequireTLS(addr string) (require bool, known bool) {
+	if i == nil {
+		return false, false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	require, known = i.tls[addr]
+	return
+}
+
+// addrConn 记录 Dial 使用的实例地址，握手时根据该地址查找实例是否要求 TLS
+type addrConn struct {
+	net.Conn
+	addr string
+}
+
+// Dial 用于 grpc.WithDialer，与 grpc 默认的 dialer 相同，同时记录连接的实例地址，
+// 地址为 resolver 返回的地址，不使用 RemoteAddr，避免域名或者 IPv6 格式不同时查找不到
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &addrConn{
+		Conn: conn,
+		addr: addr,
+	}, nil
+}
+
+// Reloader 加载 TLS 证书，证书、私钥或者 CA 文件修改之后自动重新加载，加载失败时继续使用之前的证书
+type Reloader struct {
+	conf     config.TLSConfig
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool // CAFile 为空时为 nil，即使用系统的 CA
+	modTimes map[string]time.Time
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewReloader 证书和 CA 都为空时不加载任何文件，客户端使用系统的 CA 验证服务端
+func NewReloader(conf config.TLSConfig) (*Reloader, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, fmt.Errorf("tls certFile[%s] and keyFile[%s] must be set together", conf.CertFile, conf.KeyFile)
+	}
+	r := &Reloader{
+		conf:     conf,
+		modTimes: make(map[string]time.Time),
+		done:     make(chan struct{}),
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	if len(r.files()) > 0 {
+		go r.poll()
+	}
+	return r, nil
+}
+
+func (r *Reloader) Close() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *Reloader) files() []string {
+	var files []string
+	for _, file := range []string{r.conf.CertFile, r.conf.KeyFile, r.conf.CAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (r *Reloader) poll() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if changed, err := r.reload(); err != nil {
+				logrus.Errorf("reload tls certificate failed, keep the old one, error: %v", err)
+			} else if changed {
+				logrus.Infof("tls certificate %v reloaded", r.files())
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// reload 文件修改时间发生变化时重新加载
+func (r *Reloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.conf.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.conf.CAFile != "" {
+		content, err := ioutil.ReadFile(r.conf.CAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return false, fmt.Errorf("no certificate found in tls caFile[%s]", r.conf.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	r.mu.Unlock()
+	return true, nil
+}
+
+// serverConfig 每个连接使用当前的证书和 CA
+func (r *Reloader) serverConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, fmt.Errorf("tls certificate not configured")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{*r.cert},
+		ClientCAs:    r.pool,
+		NextProtos:   []string{"h2"},
+	}
+	if r.conf.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if r.pool != nil {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+func (r *Reloader) clientConfig() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cfg := &tls.Config{
+		RootCAs:    r.pool,
+		ServerName: r.conf.ServerName,
+	}
+	if r.cert != nil {
+		cfg.Certificates = []tls.Certificate{*r.cert}
+	}
+	return cfg
+}
+
+// ServerCredentials 用于 grpc.Creds，证书重新加载之后新的连接使用新的证书
+func (r *Reloader) ServerCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: r.serverConfig,
+	})
+}
+
+// ClientCredentials 用于 grpc.WithTransportCredentials，需要同时使用 grpc.WithDialer(Dial)。
+// force 为 true 时所有的连接都使用 TLS，否则只对 instances 中要求 TLS 的实例使用 TLS，其它实例使用明文连接，
+// 不在 instances 中的地址（例如使用了自定义的 dialer）使用 TLS
+func (r *Reloader) ClientCredentials(force bool, instances *Instances) credentials.TransportCredentials {
+	return &clientCredentials{
+		reloader:  r,
+		force:     force,
+		instances: instances,
+	}
+}
+
+type clientCredentials struct {
+	reloader  *Reloader
+	force     bool
+	instances *Instances
+}
+
+// insecureAuthInfo 明文连接的 AuthInfo
+type insecureAuthInfo struct{}
+
+func (insecureAuthInfo) AuthType() string {
+	return "insecure"
+}
+
+func (c *clientCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	addr := rawConn.RemoteAddr().String()
+	require := true
+	if conn, ok := rawConn.(*addrConn); ok {
+		addr = conn.addr
+		if tls, known := c.instances.RequireTLS(addr); known && !c.force {
+			require = tls
+		}
+	}
+	if !require {
+		return rawConn, insecureAuthInfo{}, nil
+	}
+	// grpc 传入的 authority 为 Dial 的 target，没有设置 ServerName 时使用实例的 host 验证证书
+	cfg := c.reloader.clientConfig()
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName(addr)
+	}
+	return credentials.NewTLS(cfg).ClientHandshake(ctx, authority, rawConn)
+}
+
+// serverName 去掉地址中的端口和 IPv6 的中括号
+func serverName(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func (c *clientCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("tlsutil: client credentials can't be used by server")
+}
+
+// Info force 为 false 时部分连接使用明文，返回 insecure，每个连接实际使用的方式见握手返回的 AuthInfo
+func (c *clientCredentials) Info() credentials.ProtocolInfo {
+	if !c.force {
+		return credentials.ProtocolInfo{
+			SecurityProtocol: "insecure",
+			ServerName:       c.reloader.conf.ServerName,
+		}
+	}
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		SecurityVersion:  "1.2",
+		ServerName:       c.reloader.conf.ServerName,
+	}
+}
+
+func (c *clientCredentials) Clone() credentials.TransportCredentials {
+	return &clientCredentials{
+		reloader:  c.reloader,
+		force:     c.force,
+		instances: c.instances,
+	}
+}
+
+func (c *clientCredentials) OverrideServerName(serverName string) error {
+	return fmt.Errorf("tlsutil: set ClientConfig.TLS.ServerName instead")
+}
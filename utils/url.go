@@ -2,7 +2,10 @@ package utils
 
 import (
 	"fmt"
+	"net"
 	"openWebSF/config"
+	"strconv"
+	"strings"
 )
 
 func ServicePrefix(name string, groups ...string) string {
@@ -16,7 +19,7 @@ func ServicePrefix(name string, groups ...string) string {
 }
 
 func ServiceKey(name string, port int, groups ...string) string {
-	return fmt.Sprintf("%s/%s:%d", ServicePrefix(name, groups...), config.Default.LocalIPv4, port)
+	return fmt.Sprintf("%s/%s", ServicePrefix(name, groups...), net.JoinHostPort(config.Default.LocalIP, strconv.Itoa(port)))
 }
 
 func ClientPrefix(name string, groups ...string) string {
@@ -30,5 +33,44 @@ func ClientPrefix(name string, groups ...string) string {
 }
 
 func ClientKey(name string, groups ...string) string {
-	return fmt.Sprintf("%s/%s", ClientPrefix(name, groups...), config.Default.LocalIPv4)
+	return fmt.Sprintf("%s/%s", ClientPrefix(name, groups...), config.Default.LocalIP)
+}
+
+// NormalizeHostPort 检查 host:port 格式的地址，IPv6 的 host 必须使用方括号，例如 [fe80::1]:9301，
+// 没有方括号的 IPv6 地址（例如 fe80::1:9301）无法确定端口，返回错误
+func NormalizeHostPort(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("address %s: invalid port", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ParseRegistryAddr 解析注册中心地址，返回 scheme 和去掉 scheme 之后的部分
+// 例如：zookeeper:///127.0.0.1:2181,127.0.0.2:2181 => (zookeeper, /127.0.0.1:2181,127.0.0.2:2181)
+// 不带 scheme 的地址（例如 127.0.0.1:2181）返回的 scheme 为空
+func ParseRegistryAddr(addr string) (scheme string, endpoint string) {
+	spl := strings.SplitN(addr, "://", 2)
+	if len(spl) < 2 {
+		return "", addr
+	}
+	return spl[0], spl[1]
+}
+
+// RegistryServers 返回注册中心地址中的服务器列表部分
+func RegistryServers(addr string) string {
+	_, endpoint := ParseRegistryAddr(addr)
+	return strings.Trim(endpoint, "/")
+}
+
+// MethodService 返回 grpc 完整方法名中的服务名，例如 /ofo.user.v1.userService/QueryUserByToken => ofo.user.v1.userService
+func MethodService(fullMethod string) string {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i]
+	}
+	return fullMethod
 }
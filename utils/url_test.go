@@ -0,0 +1,32 @@
+package utils
+
+import "testing"
+
+func TestNormalizeHostPort(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1:9301", want: "127.0.0.1:9301"},
+		{addr: "[::1]:9301", want: "[::1]:9301"},
+		{addr: "[fe80::1]:9301", want: "[fe80::1]:9301"},
+		{addr: "localhost:9301", want: "localhost:9301"},
+		{addr: "::1:9301", wantErr: true},
+		{addr: "fe80::1:9301", wantErr: true},
+		{addr: "[::1]", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true},
+		{addr: "127.0.0.1:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := NormalizeHostPort(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeHostPort(%s) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("NormalizeHostPort(%s) = %s, want %s", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,16 +2,51 @@ package zk
 
 import (
 	"errors"
+	"fmt"
 	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	"github.com/sirupsen/logrus"
+	"openWebSF/store/etcdv3"
+	"openWebSF/store/memory"
 	"openWebSF/store/zookeeper"
+	"openWebSF/utils"
 	"strings"
 	"sync"
 )
 
 var registerZkOnce = sync.Once{}
 
+// 注册中心地址的 scheme 与 libkv store 的对应关系，不带 scheme 的地址默认使用 zookeeper
+// memory:// 使用进程内的 store，memory://name 可以指定数据集的名称
+// etcd:// 使用 etcd v3，临时节点通过 lease 实现
+var backends = struct {
+	sync.RWMutex
+	m map[string]store.Backend
+}{
+	m: map[string]store.Backend{
+		"":          zookeeper.ZK_NEW,
+		"zk":        zookeeper.ZK_NEW,
+		"zookeeper": zookeeper.ZK_NEW,
+		"memory":    memory.MEMORY,
+		"etcd":      etcdv3.ETCDV3,
+		"etcdv3":    etcdv3.ETCDV3,
+	},
+}
+
+// AddBackend 将注册中心地址的 scheme 映射到已经通过 libkv.AddStore 注册的 store
+func AddBackend(scheme string, backend store.Backend) {
+	backends.Lock()
+	defer backends.Unlock()
+	backends.m[scheme] = backend
+}
+
+func getBackend(scheme string) (store.Backend, bool) {
+	backends.RLock()
+	defer backends.RUnlock()
+	backend, ok := backends.m[scheme]
+	return backend, ok
+}
+
 type Client struct {
 	store   store.Store
 	addrs   []string
@@ -19,16 +54,28 @@ type Client struct {
 	kvNames []string
 }
 
-func New(servers string) (*Client, error) {
-	return initClient(servers)
+// New 根据注册中心地址创建 Client，地址格式为 [scheme://]server1,server2
+func New(addr string) (*Client, error) {
+	return initClient(addr)
 }
 
-func initClient(servers string) (*Client, error) {
+func initClient(addr string) (*Client, error) {
 	registerZkOnce.Do(func() {
 		zookeeper.Register()
+		memory.Register()
+		etcdv3.Register()
 	})
 
-	if "" == servers {
+	scheme, _ := utils.ParseRegistryAddr(addr)
+	backend, ok := getBackend(scheme)
+	if !ok {
+		err := fmt.Errorf("unsupported registry scheme [%s]", scheme)
+		logrus.Errorln(err)
+		return nil, err
+	}
+
+	servers := utils.RegistryServers(addr)
+	if "" == servers && backend != memory.MEMORY {
 		err := errors.New("parameter can't be empty")
 		logrus.Errorln(err)
 		return nil, err
@@ -36,21 +83,21 @@ func initClient(servers string) (*Client, error) {
 
 	serverList := strings.Split(servers, ",")
 
-	storeZk, err := libkv.NewStore(zookeeper.ZK_NEW, serverList, nil)
+	kvStore, err := libkv.NewStore(backend, serverList, nil)
 	if nil != err {
-		logrus.Errorf("connected zookeeper %s failed", serverList, err)
+		logrus.Errorf("connected %s %s failed, error: %v", backend, serverList, err)
 		return nil, err
 	}
 	return &Client{
-		store:   storeZk,
+		store:   kvStore,
 		addrs:   serverList,
 		keyMap:  make(map[string]*ZkKeyValue),
 		kvNames: make([]string, 0, 3),
 	}, nil
 }
 
-func GetStore(servers string) (store.Store, error) {
-	if client, err := initClient(servers); err != nil {
+func GetStore(addr string) (store.Store, error) {
+	if client, err := initClient(addr); err != nil {
 		return nil, err
 	} else {
 		return client.store, nil
@@ -82,6 +129,6 @@ func (c *Client) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*
 }
 
 func (c *Client) Close() {
-	logrus.Infof("closing zookeeper %v connections", c.addrs)
+	logrus.Infof("closing registry %v connections", c.addrs)
 	c.store.Close()
 }